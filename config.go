@@ -1,6 +1,45 @@
 package wal
 
-import "github.com/go-stdlog/stdlog"
+import (
+	"time"
+
+	"github.com/go-stdlog/stdlog"
+
+	"github.com/heyvito/wal/internal"
+)
+
+// SyncPolicy determines when data written to the WAL is flushed to stable
+// storage. Regardless of the policy in use, records acknowledged by
+// WriteObject survive a crash of the process itself, as long as the operating
+// system keeps running. Policies only differ in what survives a power loss or
+// a kernel crash. Use SyncEveryWrite, SyncInterval or SyncNone to obtain a
+// policy.
+type SyncPolicy = internal.SyncPolicy
+
+// SyncNone returns a policy leaving flushing to the operating system. After a
+// power loss, any record written since the last call to WAL.Sync or
+// WAL.Close may be lost. This is the default policy.
+func SyncNone() SyncPolicy {
+	return SyncPolicy{Mode: internal.SyncModeNone}
+}
+
+// SyncEveryWrite returns a policy flushing the data and index ranges touched
+// by a write, along with the directory entries of segments created to hold
+// them, before the record becomes visible to readers and WriteObject returns.
+// Once WriteObject returns successfully, the record survives a power loss.
+// In case flushing fails, the error is returned by that write and every
+// following one, as the record may or may not have reached stable storage;
+// the WAL must then be reopened.
+func SyncEveryWrite() SyncPolicy {
+	return SyncPolicy{Mode: internal.SyncModeEveryWrite}
+}
+
+// SyncInterval returns a policy that flushes pending writes every d, from a
+// background goroutine. After a power loss, records acknowledged within the
+// last interval may be lost.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{Mode: internal.SyncModeInterval, Interval: d}
+}
 
 type Config struct {
 	// DataSegmentSize defines the maximum size of a given Data Segment. This
@@ -8,9 +47,10 @@ type Config struct {
 	DataSegmentSize int64
 
 	// IndexSegmentSize indicates the maximum size of the system index before
-	// it is split into a next file. Each index record takes 41 bytes
+	// it is split into a next file. Each index record takes 45 bytes
 	// choosing a multiple of that value will prevent index segments from
-	// consuming more than it may require.
+	// consuming more than it may require. Values smaller than a single record
+	// are rounded up to fit one record.
 	IndexSegmentSize int64
 
 	// WorkDir represents the absolute path to the directory where the WAL will
@@ -22,6 +62,75 @@ type Config struct {
 	// Logger allows a given stdlog.Logger instance to be set as the system
 	// logger. If unset, no logs will be generated.
 	Logger stdlog.Logger
+
+	// SyncPolicy determines when written data is flushed to stable storage.
+	// Defaults to SyncNone. See SyncPolicy for the guarantees provided by each
+	// policy.
+	SyncPolicy SyncPolicy
+
+	// GroupCommitMaxBatch enables group commit when set to a value larger
+	// than one. Concurrent WriteObject calls are then queued and committed
+	// together in batches of up to GroupCommitMaxBatch objects, sharing a
+	// single sync when SyncEveryWrite is in use.
+	GroupCommitMaxBatch int
+
+	// GroupCommitMaxLinger determines how long a batch waits for further
+	// objects before being committed. When zero, a batch is committed as soon
+	// as no other write is waiting to be queued.
+	GroupCommitMaxLinger time.Duration
+
+	// FirstRecordID defines the id assigned to the first record written to a
+	// new WAL. It has no effect on a WorkDir that already holds a log, and
+	// defaults to zero.
+	FirstRecordID int64
+
+	// MaxMappedBytes limits the amount of bytes kept memory-mapped across
+	// index and data segments. Once exceeded, least recently used segments
+	// that are no longer written to are unmapped, and mapped again when
+	// accessed. Segments being written to are always mapped. Zero disables
+	// the limit.
+	MaxMappedBytes int64
+
+	// MaxOpenSegments limits the amount of index and data segments kept
+	// mapped, and therefore the amount of file descriptors held by the WAL,
+	// under the same rules as MaxMappedBytes. Zero disables the limit.
+	MaxOpenSegments int
+
+	// Store determines where and how segments are stored. When unset,
+	// segments are kept in WorkDir and accessed through memory maps, as
+	// provided by NewMMapStore. WorkDir is required regardless of the store
+	// in use, as it holds the WAL's lock file.
+	Store SegmentStore
+
+	// LockTimeout determines how long New waits for the WAL's lock while it
+	// is held by another process, such as a previous instance still shutting
+	// down during a rolling restart. Attempts are retried with an exponential
+	// backoff. When zero, New fails immediately. In either case, failing to
+	// obtain the lock yields a CannotAcquireWALLockError; use InspectLock to
+	// learn more about the process holding it.
+	LockTimeout time.Duration
+
+	// ReadOnly opens the WAL for reading only, allowing another process to
+	// inspect or consume it while it is being written to. Segments are
+	// mapped read-only, and are never recovered, rotated nor removed; new
+	// records and segments written by the writer are picked up by
+	// periodically re-reading segment metadata. In case no writer holds the
+	// WAL's lock, a shared lock is held while the WAL is opened, keeping
+	// writers from recovering it in the meantime; writers may open the WAL
+	// afterward, and are followed as well. Operations that change the WAL
+	// return errors.ErrReadOnly.
+	// WorkDir must exist, and the store in use must support
+	// SegmentStore.OpenReadOnly.
+	ReadOnly bool
+
+	// SharedHandles allows New to open a WorkDir already open for writing
+	// within this process, as long as every such call sets it. Each call then
+	// returns a handle to the same WAL, which is only closed once all of its
+	// handles are closed; settings other than WorkDir are taken from the
+	// first call. Otherwise, such calls fail with errors.AlreadyOpenError,
+	// as two WALs writing to the same WorkDir would corrupt it. WALs opened
+	// in read-only mode are not affected.
+	SharedHandles bool
 }
 
 func (c Config) GetIndexSegmentSize() int64 {
@@ -42,3 +151,38 @@ func (c Config) GetLogger() stdlog.Logger {
 	}
 	return stdlog.Discard
 }
+
+func (c Config) GetSyncPolicy() SyncPolicy {
+	return c.SyncPolicy
+}
+
+func (c Config) GetGroupCommitMaxBatch() int {
+	return c.GroupCommitMaxBatch
+}
+
+func (c Config) GetGroupCommitMaxLinger() time.Duration {
+	return c.GroupCommitMaxLinger
+}
+
+func (c Config) GetFirstRecordID() int64 {
+	return c.FirstRecordID
+}
+
+func (c Config) GetMaxMappedBytes() int64 {
+	return c.MaxMappedBytes
+}
+
+func (c Config) GetMaxOpenSegments() int {
+	return c.MaxOpenSegments
+}
+
+func (c Config) GetStore() SegmentStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	return NewMMapStore(c.WorkDir)
+}
+
+func (c Config) GetReadOnly() bool {
+	return c.ReadOnly
+}
@@ -1,9 +1,82 @@
 package wal
 
-import "io"
+import (
+	"context"
+	"io"
+
+	"github.com/heyvito/wal/errors"
+)
 
 type Cursor interface {
+	// Next advances the cursor to the next available object, skipping
+	// objects that have been purged. Returns false once the end of the WAL
+	// is reached, or in case an error occurs. Reaching the end of the WAL
+	// does not prevent Next from returning true again once new objects are
+	// written.
 	Next() bool
+
+	// NextWait behaves like Next, but blocks until a new object is written
+	// once the end of the WAL is reached. Returns false in case ctx is done,
+	// the WAL is closed, or an error occurs. When ctx is done, Err returns
+	// the context's error, and the cursor may still be used afterward.
+	// Under SyncEveryWrite, it is only woken once the new object is synced.
+	NextWait(ctx context.Context) bool
+
+	// Prev moves the cursor to the previous available object, skipping
+	// objects that have been purged. Returns false once the first available
+	// object has been passed, or in case an error occurs.
+	Prev() bool
+
+	// SeekTo positions the cursor so that Next yields the first available
+	// object with an id equal to or greater than id, and Prev yields the
+	// last available object with a smaller id. The id is clamped between
+	// MinimumRecordID and the id following CurrentRecordID. Seeking clears
+	// any error reported by Err, unless the WAL has been closed.
+	SeekTo(id int64)
+
+	// SeekToFirst positions the cursor so that Next yields the first
+	// available object.
+	SeekToFirst()
+
+	// SeekToLast positions the cursor after the last object, so that Prev
+	// yields it. Use it along with Prev to obtain the latest objects.
+	SeekToLast()
+
+	// Close releases resources held by the cursor. Cursors obtained through
+	// ReadObjectsSnapshot must be closed, as they keep the disk space taken
+	// by vacuumed segments from being reclaimed; closing them waits for
+	// in-progress writes. Further calls to Next or Prev return false.
+	Close() error
+
+	// Read returns a reader for the current object's data, which holds the
+	// object's segments as readers returned by WAL.ReadObject do. In case the
+	// object's data is corrupted, the CorruptedRecordError returned is also
+	// reported by Err.
 	Read() (io.Reader, error)
 	Offset() int64
+
+	// Err returns the error that caused Next to return false, or nil in case
+	// the end of the WAL was reached. Errors are either a VacuumedError, in
+	// case the next object was vacuumed from under the cursor, a
+	// CorruptedRecordError returned by Read, ErrClosed, or the error of the
+	// context provided to NextWait. Except for the latter, errors persist,
+	// and Next and Prev return false, until the cursor is repositioned
+	// through SeekTo, SeekToFirst or SeekToLast; for instance, calling
+	// SeekTo(Offset()+1) skips a corrupted object.
+	Err() error
 }
+
+// closedCursor is returned by handles that have been closed. It yields no
+// objects, and reports ErrClosed.
+type closedCursor struct{}
+
+func (closedCursor) Next() bool                    { return false }
+func (closedCursor) NextWait(context.Context) bool { return false }
+func (closedCursor) Prev() bool                    { return false }
+func (closedCursor) SeekTo(int64)                  {}
+func (closedCursor) SeekToFirst()                  {}
+func (closedCursor) SeekToLast()                   {}
+func (closedCursor) Close() error                  { return nil }
+func (closedCursor) Read() (io.Reader, error)      { return nil, errors.ErrClosed }
+func (closedCursor) Offset() int64                 { return -1 }
+func (closedCursor) Err() error                    { return errors.ErrClosed }
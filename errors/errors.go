@@ -1,6 +1,9 @@
 package errors
 
-import "fmt"
+import (
+	errs "errors"
+	"fmt"
+)
 
 // CannotAcquireWALLockError indicates that the WAL Lock could not be obtained
 // since it is in use by another process. The process holding the lock is
@@ -22,3 +25,91 @@ type NotFound struct {
 func (n NotFound) Error() string {
 	return fmt.Sprintf("record %d not found", n.RecordID)
 }
+
+// VacuumedError indicates that a cursor could not advance to a record, as it
+// has been vacuumed after the cursor was positioned.
+type VacuumedError struct {
+	RecordID int64
+}
+
+func (v VacuumedError) Error() string {
+	return fmt.Sprintf("record %d has been vacuumed", v.RecordID)
+}
+
+// CorruptedRecordError indicates that the data stored for a given record does
+// not match the checksum computed when it was written. SegmentID and Offset
+// indicate the data segment and the offset within it where the record's data
+// starts.
+type CorruptedRecordError struct {
+	RecordID  int64
+	SegmentID int64
+	Offset    int64
+	Expected  uint32
+	Actual    uint32
+}
+
+func (c CorruptedRecordError) Error() string {
+	return fmt.Sprintf("record %d is corrupted: checksum mismatch at data segment %d, offset %d (expected %08x, got %08x)", c.RecordID, c.SegmentID, c.Offset, c.Expected, c.Actual)
+}
+
+// ErrClosed indicates that an operation was attempted against a WAL that has
+// already been closed.
+var ErrClosed = errs.New("wal is closed")
+
+// BatchTooLargeError indicates that a batch holds more objects than can be
+// atomically published within a single index segment. Limit holds the
+// maximum amount of objects a batch may contain.
+type BatchTooLargeError struct {
+	Objects int
+	Limit   int64
+}
+
+func (b BatchTooLargeError) Error() string {
+	return fmt.Sprintf("batch of %d objects exceeds the limit of %d objects per batch", b.Objects, b.Limit)
+}
+
+// ErrNoSpace indicates that space for a new segment could not be reserved,
+// as the filesystem holding it is full. The write that required the segment
+// is not committed, and may be retried once space is freed.
+var ErrNoSpace = errs.New("no space left to reserve segment")
+
+// ErrReadOnly indicates that an operation requiring write access was
+// attempted on a WAL opened in read-only mode.
+var ErrReadOnly = errs.New("wal is open in read-only mode")
+
+// StaleEpochError indicates that a write was rejected because another writer
+// opened the WAL after the handle attempting it, and took over its WorkDir.
+// Epoch holds the epoch of the handle, and Current the epoch of the writer
+// that took over. The handle must be closed, as it will never write again.
+type StaleEpochError struct {
+	Epoch   int64
+	Current int64
+}
+
+func (s StaleEpochError) Error() string {
+	return fmt.Sprintf("wal handle from epoch %d is stale, as epoch %d has been started by another writer", s.Epoch, s.Current)
+}
+
+// SnapshotInUseError indicates that records could not be truncated, as they
+// are held by a cursor obtained through ReadObjectsSnapshot that has not been
+// closed yet. RecordID holds the id records were to be truncated after, and
+// Upper the id of the last record held by the snapshot.
+type SnapshotInUseError struct {
+	RecordID int64
+	Upper    int64
+}
+
+func (s SnapshotInUseError) Error() string {
+	return fmt.Sprintf("cannot truncate after record %d, as records up to %d are held by a snapshot", s.RecordID, s.Upper)
+}
+
+// AlreadyOpenError indicates that a WAL could not be opened for writing, as
+// its WorkDir is already open for writing within the same process. WorkDir
+// holds the canonical path of the directory.
+type AlreadyOpenError struct {
+	WorkDir string
+}
+
+func (a AlreadyOpenError) Error() string {
+	return fmt.Sprintf("wal at %s is already open in this process", a.WorkDir)
+}
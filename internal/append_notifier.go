@@ -0,0 +1,49 @@
+package internal
+
+import "sync"
+
+// appendNotifier wakes goroutines waiting for new records. Waiters share a
+// single channel, which is closed and discarded whenever records are
+// appended, so no goroutine is required per waiter.
+type appendNotifier struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed bool
+}
+
+// wait returns a channel that is closed once new records are appended, or the
+// notifier itself is closed.
+func (n *appendNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// notify wakes all current waiters. Channels are only allocated while there
+// are waiters, so appends without tailing cursors do not allocate.
+func (n *appendNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed || n.ch == nil {
+		return
+	}
+	close(n.ch)
+	n.ch = nil
+}
+
+// close wakes all current and future waiters.
+func (n *appendNotifier) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = true
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	close(n.ch)
+}
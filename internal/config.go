@@ -1,10 +1,22 @@
 package internal
 
-import "github.com/go-stdlog/stdlog"
+import (
+	"time"
+
+	"github.com/go-stdlog/stdlog"
+)
 
 type Config interface {
 	GetIndexSegmentSize() int64
 	GetDataSegmentSize() int64
 	GetWorkdir() string
 	GetLogger() stdlog.Logger
+	GetSyncPolicy() SyncPolicy
+	GetGroupCommitMaxBatch() int
+	GetGroupCommitMaxLinger() time.Duration
+	GetFirstRecordID() int64
+	GetMaxMappedBytes() int64
+	GetMaxOpenSegments() int
+	GetStore() SegmentStore
+	GetReadOnly() bool
 }
@@ -12,6 +12,7 @@ var indexSegmentOffsets = struct {
 	RecordsCount uint8
 	Cursor       uint8
 	Flags        uint8
+	Epoch        uint8
 }{
 	SegmentID:    0,
 	Size:         8,
@@ -20,8 +21,15 @@ var indexSegmentOffsets = struct {
 	RecordsCount: 32,
 	Cursor:       40,
 	Flags:        48,
+	Epoch:        49,
 }
 
+const (
+	indexSegmentFlagPurged      = 0x01 << 0
+	indexSegmentFlagChecksummed = 0x01 << 1
+	indexSegmentFlagEpoch       = 0x01 << 2
+)
+
 var indexRecordOffsets = struct {
 	RecordID           uint8
 	DataSegmentStartID uint8
@@ -29,6 +37,7 @@ var indexRecordOffsets = struct {
 	DataSegmentOffset  uint8
 	Size               uint8
 	Flags              uint8
+	Checksum           uint8
 }{
 	RecordID:           0,
 	DataSegmentStartID: 8,
@@ -36,6 +45,7 @@ var indexRecordOffsets = struct {
 	DataSegmentOffset:  24,
 	Size:               32,
 	Flags:              40,
+	Checksum:           41,
 }
 
 var dataSegmentOffsets = struct {
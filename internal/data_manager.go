@@ -1,17 +1,20 @@
 package internal
 
 import (
+	"bytes"
+	errs "errors"
 	"fmt"
 	"github.com/heyvito/wal/internal/metrics"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
-	"slices"
-	"strconv"
-	"strings"
+	"runtime"
 	"sync"
 	"sync/atomic"
 
 	"github.com/go-stdlog/stdlog"
+	"github.com/heyvito/wal/errors"
 )
 
 type DataManager struct {
@@ -24,13 +27,26 @@ type DataManager struct {
 	CurrentSegment *DataSegment
 	log            stdlog.Logger
 
-	writeMu sync.Mutex
+	writeMu  sync.Mutex
+	unsynced []*DataSegment
+	cache    *segmentCache
+
+	// unsyncedDir indicates whether segments were created since the last
+	// call to Sync, in which case their directory entries must be synced.
+	unsyncedDir bool
 }
 
 func NewDataManager(config Config) (*DataManager, error) {
+	return newDataManager(config, newSegmentCache(config), nil)
+}
+
+// newDataManager creates a DataManager tracking its segment mappings through
+// a given cache, which may be shared with an Index. Segments described by
+// man, when provided, are loaded from it.
+func newDataManager(config Config, cache *segmentCache, man *manifest) (*DataManager, error) {
 	wd := config.GetWorkdir()
 	stat, err := os.Stat(wd)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && !config.GetReadOnly() {
 		if err = os.MkdirAll(wd, 0755); err != nil {
 			return nil, err
 		}
@@ -42,28 +58,12 @@ func NewDataManager(config Config) (*DataManager, error) {
 
 	log := config.GetLogger().Named("data_manager")
 
-	var segmentsToLoad []int64
-	entries, err := os.ReadDir(wd)
+	segmentsToLoad, err := listSegments(config.GetStore(), dataSegmentPrefix, log)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if !strings.HasPrefix(entry.Name(), "data") {
-			continue
-		}
-		id, err := strconv.ParseInt(entry.Name()[4:], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("%s: invalid data segment file name: %w", entry.Name(), err)
-		}
-		segmentsToLoad = append(segmentsToLoad, id)
-	}
-
 	log.Info("Loading data segments", "size", len(segmentsToLoad))
-	slices.Sort(segmentsToLoad)
 
 	d := &DataManager{
 		Config:         config,
@@ -71,17 +71,29 @@ func NewDataManager(config Config) (*DataManager, error) {
 		CurrentSegment: nil,
 		MinSegment:     -1,
 		log:            log,
+		cache:          cache,
 	}
 
 	d.MaxSegment.Store(-1)
 
-	for _, id := range segmentsToLoad {
-		segment, err := NewDataSegment(id, config)
+	// Segments described by the manifest are loaded without being opened.
+	// The last segment is always read from disk, as it is written to.
+	segments, err := loadSegments(segmentsToLoad, func(id int64) (*DataSegment, error) {
+		if entry, ok := man.dataEntry(id); ok && id != segmentsToLoad[len(segmentsToLoad)-1] {
+			return dataSegmentFromManifest(entry, config, cache), nil
+		}
+		segment, err := openDataSegment(id, config, cache, true)
 		if err != nil {
-			_ = d.Close()
 			log.Error(err, "Failed loading data segment", "id", id)
-			return nil, err
 		}
+		return segment, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for n, segment := range segments {
+		id := segmentsToLoad[n]
 		if d.MinSegment == -1 || id < d.MinSegment {
 			d.MinSegment = id
 		}
@@ -91,15 +103,24 @@ func NewDataManager(config Config) (*DataManager, error) {
 			d.CurrentSegment = segment
 			d.MaxSegment.Store(id)
 		}
-		if id > d.CurrentSegment.SegmentID {
-			d.MaxSegment.Store(id)
-		}
+	}
+
+	// Read-only managers neither create segments, nor keep the current one
+	// mapped, as it is not written to.
+	if config.GetReadOnly() {
+		return d, nil
 	}
 
 	if len(segmentsToLoad) == 0 {
 		return d, d.Rotate()
 	}
 
+	if err = d.CurrentSegment.unseal(); err != nil {
+		_ = d.Close()
+		log.Error(err, "Failed mapping data segment", "id", d.CurrentSegment.SegmentID)
+		return nil, err
+	}
+
 	return d, nil
 }
 
@@ -113,12 +134,64 @@ func (m *DataManager) Close() error {
 	return nil
 }
 
+// refresh loads data segments created by the process writing to the WAL, and
+// drops the ones it removed. Only used by read-only managers.
+func (m *DataManager) refresh() error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	ids, err := listSegments(m.Config.GetStore(), dataSegmentPrefix, m.log)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+		if _, ok := m.Segments.Load(id); ok {
+			continue
+		}
+		seg, err := openDataSegment(id, m.Config, m.cache, true)
+		if errs.Is(err, fs.ErrNotExist) {
+			// Removed by the writer since being listed.
+			continue
+		} else if err != nil {
+			return err
+		}
+		m.Segments.Store(id, seg)
+		m.LoadedSegments.Add(1)
+	}
+
+	m.MinSegment = -1
+	m.MaxSegment.Store(-1)
+	m.CurrentSegment = nil
+	for id, seg := range m.Segments.Range() {
+		if !present[id] {
+			if err = seg.Close(); err != nil {
+				return err
+			}
+			m.Segments.Delete(id)
+			m.LoadedSegments.Add(-1)
+			continue
+		}
+		if m.MinSegment == -1 || id < m.MinSegment {
+			m.MinSegment = id
+		}
+		if id > m.MaxSegment.Load() {
+			m.MaxSegment.Store(id)
+			m.CurrentSegment = seg
+		}
+	}
+	return nil
+}
+
 func (m *DataManager) Rotate() error {
 	var seg *DataSegment
 	var err error
 
+	prev := m.CurrentSegment
 	if m.CurrentSegment == nil {
-		seg, err = NewDataSegment(0, m.Config)
+		seg, err = openDataSegment(0, m.Config, m.cache, false)
 		if err != nil {
 			return err
 		}
@@ -126,16 +199,23 @@ func (m *DataManager) Rotate() error {
 		m.MaxSegment.Store(0)
 		m.Segments.Store(0, seg)
 		m.CurrentSegment = seg
+		m.unsyncedDir = true
 	} else {
-		seg, err = NewDataSegment(m.CurrentSegment.SegmentID+1, m.Config)
+		seg, err = openDataSegment(m.CurrentSegment.SegmentID+1, m.Config, m.cache, false)
 		if err != nil {
 			return err
 		}
 		m.CurrentSegment = seg
 		m.Segments.Store(seg.SegmentID, seg)
 		m.MaxSegment.Store(seg.SegmentID)
+		m.unsyncedDir = true
 	}
 	m.LoadedSegments.Add(1)
+	if prev != nil {
+		prev.seal()
+	} else {
+		m.cache.enforce()
+	}
 	return nil
 }
 
@@ -146,6 +226,45 @@ func (m *DataManager) Write(data []byte, rec *IndexRecord) error {
 	defer metrics.Measure(metrics.DataManagerWriteLatency)()
 	metrics.Simple(metrics.DataManagerWriteCalls, 0)
 
+	if err := m.beginLocked(rec); err != nil {
+		return err
+	}
+	return m.appendLocked(data, rec)
+}
+
+// Begin positions a given record at the current end of the data stream,
+// without writing any data. Data for the record can then be written in
+// chunks through Append.
+func (m *DataManager) Begin(rec *IndexRecord) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.beginLocked(rec)
+}
+
+// Append writes a chunk of data right after the data previously written for
+// the provided record, rotating segments as required.
+func (m *DataManager) Append(data []byte, rec *IndexRecord) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	defer metrics.Measure(metrics.DataManagerWriteLatency)()
+	metrics.Simple(metrics.DataManagerWriteCalls, 0)
+
+	return m.appendLocked(data, rec)
+}
+
+// Rewind discards all data written from the start of the provided record on,
+// including segments created after it.
+func (m *DataManager) Rewind(rec *IndexRecord) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	discarded, err := m.truncate(rec.DataSegmentStartID, rec.DataSegmentOffset)
+	m.log.Debug("Rewound data stream", "segment_id", rec.DataSegmentStartID, "offset", rec.DataSegmentOffset, "bytes", discarded)
+	return err
+}
+
+func (m *DataManager) beginLocked(rec *IndexRecord) error {
 	if !m.CurrentSegment.Available() {
 		if err := m.Rotate(); err != nil {
 			return err
@@ -153,9 +272,14 @@ func (m *DataManager) Write(data []byte, rec *IndexRecord) error {
 	}
 
 	rec.DataSegmentStartID = m.CurrentSegment.SegmentID
+	rec.DataSegmentEndID = m.CurrentSegment.SegmentID
+	rec.DataSegmentOffset = m.CurrentSegment.Cursor.Load()
+	return nil
+}
+
+func (m *DataManager) appendLocked(data []byte, rec *IndexRecord) error {
 	var written int64
 	dataLen := int64(len(data))
-	var wr int64
 
 	for written < dataLen {
 		if !m.CurrentSegment.Available() {
@@ -163,12 +287,9 @@ func (m *DataManager) Write(data []byte, rec *IndexRecord) error {
 				return err
 			}
 		}
-		if written == 0 {
-			rec.DataSegmentOffset, written = m.CurrentSegment.Write(data)
-		} else {
-			_, wr = m.CurrentSegment.Write(data[written:])
-			written += wr
-		}
+		_, wr := m.CurrentSegment.Write(data[written:])
+		written += wr
+		m.markUnsynced(m.CurrentSegment)
 	}
 
 	rec.DataSegmentEndID = m.CurrentSegment.SegmentID
@@ -176,32 +297,231 @@ func (m *DataManager) Write(data []byte, rec *IndexRecord) error {
 	return nil
 }
 
-func (m *DataManager) Read(rec *IndexRecord) (io.Reader, error) {
+// Recover rewinds the data manager so that its logical end matches the end of
+// the provided record, which must be the last record committed to the index.
+// Data written after that point was never published, and is discarded.
+// Passing a nil record discards all data held by the manager.
+func (m *DataManager) Recover(last *IndexRecord) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	segID, offset := m.MinSegment, int64(0)
+	if last != nil {
+		var err error
+		if segID, offset, err = m.endOf(last); err != nil {
+			return err
+		}
+	}
+
+	discarded, err := m.truncate(segID, offset)
+	if err != nil {
+		return err
+	}
+
+	if discarded > 0 {
+		m.log.Warning("Discarded uncommitted data", "bytes", discarded, "segment_id", segID, "offset", offset)
+	} else {
+		m.log.Info("Data segments are consistent with index", "segment_id", segID, "offset", offset)
+	}
+	return nil
+}
+
+// endOf returns the segment and offset right after the last byte belonging
+// to a given record.
+func (m *DataManager) endOf(rec *IndexRecord) (segID, offset int64, err error) {
+	segID, offset = rec.DataSegmentStartID, rec.DataSegmentOffset
+	remaining := rec.Size
+	for {
+		seg, ok := m.Segments.Load(segID)
+		if !ok {
+			return 0, 0, fmt.Errorf("segment %d not found", segID)
+		}
+		if avail := seg.Size - offset; remaining > avail {
+			remaining -= avail
+			segID++
+			offset = 0
+			continue
+		}
+		return segID, offset + remaining, nil
+	}
+}
+
+// truncate sets the logical end of the data stream at a given segment and
+// offset. Segments after segID are unlinked. Returns the amount of bytes
+// discarded in the process.
+func (m *DataManager) truncate(segID, offset int64) (int64, error) {
+	var discarded int64
+	for id, seg := range m.Segments.Range() {
+		switch {
+		case id < segID:
+			// Segments preceding the end were filled before rotation took
+			// place, but their cursor may not have been persisted.
+			if seg.Cursor.Load() != seg.Size {
+				if err := seg.Acquire(); err != nil {
+					return discarded, err
+				}
+				seg.Cursor.Store(seg.Size)
+				seg.FlushMetadata()
+				if err := seg.Release(); err != nil {
+					return discarded, err
+				}
+			}
+		case id == segID:
+			if err := seg.unseal(); err != nil {
+				return discarded, err
+			}
+			if cur := seg.Cursor.Load(); cur > offset {
+				discarded += cur - offset
+			}
+			seg.Cursor.Store(offset)
+			seg.FlushMetadata()
+		default:
+			discarded += seg.Cursor.Load()
+			m.log.Debug("Unlinking segment", "segment_id", id)
+			if err := seg.Unlink(); err != nil {
+				m.log.Error(err, "Failed unlinking segment", "segment_id", id)
+				return discarded, err
+			}
+			m.Segments.Delete(id)
+			m.LoadedSegments.Add(-1)
+		}
+	}
+
+	seg, ok := m.Segments.Load(segID)
+	if !ok {
+		return discarded, fmt.Errorf("segment %d not found", segID)
+	}
+	m.CurrentSegment = seg
+	m.MaxSegment.Store(segID)
+	return discarded, nil
+}
+
+func (m *DataManager) markUnsynced(seg *DataSegment) {
+	if n := len(m.unsynced); n > 0 && m.unsynced[n-1] == seg {
+		return
+	}
+	m.unsynced = append(m.unsynced, seg)
+}
+
+// Sync flushes all data written since the last call to Sync to stable
+// storage, along with the directory entries of segments created meanwhile.
+func (m *DataManager) Sync() error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	for len(m.unsynced) > 0 {
+		seg := m.unsynced[0]
+		if cur, ok := m.Segments.Load(seg.SegmentID); ok && cur == seg {
+			if err := seg.Sync(); err != nil {
+				return err
+			}
+		}
+		m.unsynced = m.unsynced[1:]
+	}
+	m.unsynced = nil
+
+	if m.unsyncedDir {
+		if err := m.Config.GetStore().Sync(); err != nil {
+			return err
+		}
+		m.unsyncedDir = false
+	}
+	return nil
+}
+
+// Read returns a reader for the data of a given record. The reader holds a
+// reference to each segment it reads from, released once the reader reaches
+// EOF, is closed, or is garbage collected.
+func (m *DataManager) Read(rec *IndexRecord) (io.ReadCloser, error) {
 	defer metrics.Measure(metrics.DataManagerReadLatency)()
 	metrics.Simple(metrics.DataManagerReadCalls, 0)
 
 	var readers []io.Reader
+	r := &segmentReader{}
 
 	size := rec.Size
 	segID := rec.DataSegmentStartID
 	offset := rec.DataSegmentOffset
+	crc := uint32(0)
 
 	for size > 0 {
 		seg, ok := m.Segments.Load(segID)
 		if !ok {
+			_ = r.Close()
 			return nil, fmt.Errorf("segment %d not found", segID)
 		}
-		reader, limit := seg.Reader(offset, size)
+		if err := seg.Acquire(); err == errSegmentReleased {
+			_ = r.Close()
+			return nil, fmt.Errorf("segment %d not found", segID)
+		} else if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r.segments = append(r.segments, seg)
+		data := seg.Bytes(offset, size)
+		if rec.Checksummed {
+			crc = crc32.Update(crc, crcTable, data)
+		}
 		offset = 0
-		readers = append(readers, reader)
-		size -= limit
+		readers = append(readers, bytes.NewReader(data))
+		size -= int64(len(data))
 		segID++
 	}
 
-	return io.MultiReader(readers...), nil
+	if rec.Checksummed && crc != rec.Checksum {
+		_ = r.Close()
+		metrics.Simple(metrics.DataManagerChecksumFailures, 0)
+		return nil, errors.CorruptedRecordError{
+			RecordID:  rec.RecordID,
+			SegmentID: rec.DataSegmentStartID,
+			Offset:    rec.DataSegmentOffset,
+			Expected:  rec.Checksum,
+			Actual:    crc,
+		}
+	}
+
+	r.reader = io.MultiReader(readers...)
+	if r.segments != nil {
+		runtime.SetFinalizer(r, (*segmentReader).Close)
+	}
+	return r, nil
+}
+
+// segmentReader reads data backed by segments' memory, releasing its
+// references to them once it reaches EOF or is closed.
+type segmentReader struct {
+	reader   io.Reader
+	segments []*DataSegment
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if r.segments == nil {
+		return 0, io.EOF
+	}
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		if closeErr := r.Close(); closeErr != nil {
+			return n, closeErr
+		}
+	}
+	return n, err
 }
 
-func (m *DataManager) VacuumDataSegments(idsInUse []int64) error {
+func (r *segmentReader) Close() error {
+	runtime.SetFinalizer(r, nil)
+	var err error
+	for _, seg := range r.segments {
+		if releaseErr := seg.Release(); releaseErr != nil {
+			err = releaseErr
+		}
+	}
+	r.segments = nil
+	return err
+}
+
+// VacuumDataSegments removes data segments not listed in idsInUse, except for
+// the ones starting at keepFrom, which hold data still being written.
+func (m *DataManager) VacuumDataSegments(idsInUse []int64, keepFrom int64) error {
 	m.writeMu.Lock()
 	defer m.writeMu.Unlock()
 
@@ -216,9 +536,10 @@ func (m *DataManager) VacuumDataSegments(idsInUse []int64) error {
 		inUse[id] = struct{}{}
 	}
 
+	currentRemoved := false
 	for k, v := range m.Segments.Range() {
 		_, ok := inUse[k]
-		if ok {
+		if ok || k >= keepFrom {
 			continue
 		}
 		m.log.Debug("Unlinking segment", "segment_id", k)
@@ -228,15 +549,17 @@ func (m *DataManager) VacuumDataSegments(idsInUse []int64) error {
 		}
 		m.Segments.Delete(k)
 		m.LoadedSegments.Add(-1)
+		if v == m.CurrentSegment {
+			currentRemoved = true
+		}
 	}
 
-	if m.LoadedSegments.Load() == 0 {
-		m.log.Debug("All segments were cleared during vacuum. Recreating initial segment...")
+	if currentRemoved {
+		m.log.Debug("Current segment was cleared during vacuum. Creating a new segment...")
 		if err := m.Rotate(); err != nil {
-			m.log.Error(err, "Failed creating initial segment")
+			m.log.Error(err, "Failed creating new segment")
 			return err
 		}
-		m.MaxSegment.Store(0)
 	}
 
 	maxSeg := int64(0)
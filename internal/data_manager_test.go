@@ -3,8 +3,10 @@ package internal
 import (
 	"io"
 	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -221,3 +223,30 @@ func TestDataManagerRace(t *testing.T) {
 	err = dm.Close()
 	require.NoError(t, err)
 }
+
+func TestDataManagerReadReleasedOnCollection(t *testing.T) {
+	conf := NewDummyConfig(t)
+	dm, err := NewDataManager(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, dm.Close()) }()
+
+	rec := &IndexRecord{Size: 32}
+	require.NoError(t, dm.Write(randomData(t, 32), rec))
+	seg, ok := dm.Segments.Load(rec.DataSegmentStartID)
+	require.True(t, ok)
+
+	func() {
+		r, err := dm.Read(rec)
+		require.NoError(t, err)
+		_, err = r.Read(make([]byte, 8))
+		require.NoError(t, err)
+	}()
+	assert.Equal(t, int64(2), seg.refs.count.Load())
+
+	// Readers dropped before reaching EOF release their segments once
+	// collected.
+	assert.Eventually(t, func() bool {
+		runtime.GC()
+		return seg.refs.count.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,75 +2,95 @@ package internal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
-
-	"github.com/heyvito/gommap"
 )
 
 const dataSegmentMetadataSize = 8 * 3
 
 type DataSegment struct {
 	Path string
-	File *os.File
+	File SegmentFile
 
 	SegmentID int64
 	Size      int64
 	Cursor    atomic.Int64
 
-	RawData  gommap.MMap
-	Metadata gommap.MMap
-	Records  gommap.MMap
+	RawData  []byte
+	Metadata []byte
+	Records  []byte
 	writeMu  sync.Mutex
+
+	dirty dirtyRange
+	refs  segmentRefs
+
+	// mapMu guards RawData, Metadata, Records and File, which are only set
+	// while the segment is mapped. sealed indicates whether the segment is
+	// no longer written to, and may be unmapped by cache.
+	mapMu  sync.Mutex
+	sealed atomic.Bool
+	cache  *segmentCache
+
+	name  string
+	store SegmentStore
+
+	// readOnly indicates whether the segment belongs to a read-only index,
+	// in which case it is mapped read-only and never written to. Segments
+	// fenced out by another writer are never flushed either. Guarded by
+	// mapMu.
+	readOnly bool
 }
 
 func NewDataSegment(id int64, config Config) (*DataSegment, error) {
-	path := filepath.Join(config.GetWorkdir(), fmt.Sprintf("data%04d", id))
-	var fd *os.File
-	stat, err := os.Stat(path)
-	isNew := false
-	switch {
-	case os.IsNotExist(err):
-		fd, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL|os.O_SYNC, 0644)
-		isNew = true
-	case err != nil:
-		return nil, err
-	case stat.IsDir():
-		return nil, fmt.Errorf("%s: is a directory", path)
-	default:
-		fd, err = os.OpenFile(path, os.O_RDWR|os.O_EXCL|os.O_SYNC, 0644)
-	}
-	if err != nil {
-		return nil, err
-	}
+	return openDataSegment(id, config, nil, false)
+}
 
-	if isNew {
-		if err = fd.Truncate(config.GetDataSegmentSize() + dataSegmentMetadataSize); err != nil {
-			_ = fd.Close()
+// openDataSegment opens the data segment identified by id, creating it when
+// it does not exist. When lazy is set, an existing segment only has its
+// metadata read, being mapped once acquired. Mappings are tracked by the
+// provided cache. Read-only configurations never create segments.
+func openDataSegment(id int64, config Config, cache *segmentCache, lazy bool) (*DataSegment, error) {
+	name := dataSegmentName(id)
+	store := config.GetStore()
+	readOnly := config.GetReadOnly()
+	isNew := false
+	if !readOnly {
+		err := store.Create(name, config.GetDataSegmentSize()+dataSegmentMetadataSize)
+		isNew = err == nil
+		if err != nil && !errors.Is(err, fs.ErrExist) {
 			return nil, err
 		}
 	}
 
-	mapped, err := gommap.Map(fd.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
-	if err != nil {
-		_ = fd.Close()
-		return nil, err
-	}
-
 	seg := &DataSegment{
-		Path:      path,
-		File:      fd,
+		Path:      filepath.Join(config.GetWorkdir(), name),
 		SegmentID: id,
 		Size:      config.GetDataSegmentSize(),
-		RawData:   mapped,
-		Metadata:  mapped[:dataSegmentMetadataSize],
-		Records:   mapped[dataSegmentMetadataSize:],
+		cache:     cache,
+		name:      name,
+		store:     store,
+		readOnly:  readOnly,
+	}
+	seg.refs.init()
+
+	if lazy && !isNew {
+		meta := make([]byte, dataSegmentMetadataSize)
+		if err := store.ReadAt(name, meta, 0); err != nil {
+			return nil, err
+		}
+		seg.loadMetadata(meta)
+		seg.sealed.Store(true)
+		return seg, nil
 	}
 
+	if err := seg.mapLocked(); err != nil {
+		return nil, err
+	}
 	if isNew {
 		seg.FlushMetadata()
 	} else {
@@ -80,16 +100,43 @@ func NewDataSegment(id int64, config Config) (*DataSegment, error) {
 	return seg, nil
 }
 
+// dataSegmentFromManifest returns an unmapped segment whose metadata is
+// described by a manifest entry.
+func dataSegmentFromManifest(entry []byte, config Config, cache *segmentCache) *DataSegment {
+	seg := &DataSegment{cache: cache, store: config.GetStore(), readOnly: config.GetReadOnly()}
+	seg.loadMetadata(entry)
+	seg.name = dataSegmentName(seg.SegmentID)
+	seg.Path = filepath.Join(config.GetWorkdir(), seg.name)
+	seg.refs.init()
+	seg.sealed.Store(true)
+	return seg
+}
+
+func dataSegmentName(id int64) string {
+	return fmt.Sprintf("%s%04d", dataSegmentPrefix, id)
+}
+
 func (s *DataSegment) FlushMetadata() {
-	be.PutUint64(s.Metadata[dataSegmentOffsets.SegmentID:], uint64(s.SegmentID))
-	be.PutUint64(s.Metadata[dataSegmentOffsets.Size:], uint64(s.Size))
-	be.PutUint64(s.Metadata[dataSegmentOffsets.Cursor:], uint64(s.Cursor.Load()))
+	s.encodeMetadata(s.Metadata)
+	s.File.Flush(0, dataSegmentMetadataSize)
+}
+
+// encodeMetadata writes the segment's metadata into b, using the layout of
+// the segment's header.
+func (s *DataSegment) encodeMetadata(b []byte) {
+	be.PutUint64(b[dataSegmentOffsets.SegmentID:], uint64(s.SegmentID))
+	be.PutUint64(b[dataSegmentOffsets.Size:], uint64(s.Size))
+	be.PutUint64(b[dataSegmentOffsets.Cursor:], uint64(s.Cursor.Load()))
 }
 
 func (s *DataSegment) LoadMetadata() {
-	s.SegmentID = int64(be.Uint64(s.Metadata[dataSegmentOffsets.SegmentID:]))
-	s.Size = int64(be.Uint64(s.Metadata[dataSegmentOffsets.Size:]))
-	s.Cursor.Store(int64(be.Uint64(s.Metadata[dataSegmentOffsets.Cursor:])))
+	s.loadMetadata(s.Metadata)
+}
+
+func (s *DataSegment) loadMetadata(b []byte) {
+	s.SegmentID = int64(be.Uint64(b[dataSegmentOffsets.SegmentID:]))
+	s.Size = int64(be.Uint64(b[dataSegmentOffsets.Size:]))
+	s.Cursor.Store(int64(be.Uint64(b[dataSegmentOffsets.Cursor:])))
 }
 
 func (s *DataSegment) Read(into []byte, offset int64) int64 {
@@ -100,6 +147,14 @@ func (s *DataSegment) Read(into []byte, offset int64) int64 {
 }
 
 func (s *DataSegment) Reader(offset, size int64) (io.Reader, int64) {
+	data := s.Bytes(offset, size)
+	return bytes.NewReader(data), int64(len(data))
+}
+
+// Bytes returns a slice of the segment's records area starting at a given
+// offset, limited to the provided size or the end of the segment, whichever
+// comes first. The returned slice is backed by the segment's file contents.
+func (s *DataSegment) Bytes(offset, size int64) []byte {
 	if offset+size > s.Size {
 		size = s.Size - offset
 	}
@@ -108,7 +163,7 @@ func (s *DataSegment) Reader(offset, size int64) (io.Reader, int64) {
 		size = s.Size
 	}
 
-	return bytes.NewReader(s.Records[offset : offset+size]), size
+	return s.Records[offset : offset+size]
 }
 
 func (s *DataSegment) Write(data []byte) (offset int64, written int64) {
@@ -117,18 +172,176 @@ func (s *DataSegment) Write(data []byte) (offset int64, written int64) {
 
 	offset = s.Cursor.Load()
 	written = int64(copy(s.Records[offset:], data))
+	s.File.Flush(dataSegmentMetadataSize+offset, written)
 	s.Cursor.Add(written)
+	s.dirty.mark(offset, written)
 	return
 }
 
-func (s *DataSegment) Close() error {
+// Sync flushes the region of the segment written since the last call to Sync
+// to stable storage.
+func (s *DataSegment) Sync() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
 	s.writeMu.Lock()
-	defer s.writeMu.Unlock()
-	s.FlushMetadata()
-	if err := s.RawData.Sync(gommap.MS_SYNC); err != nil {
+	offset, size := s.dirty.take()
+	s.writeMu.Unlock()
+	if s.RawData == nil {
+		return nil
+	}
+	return s.File.Sync(dataSegmentMetadataSize+offset, size)
+}
+
+// Acquire obtains a reference to the segment, mapping it in case it is not
+// mapped, and preventing its memory from being unmapped until Release is
+// called. Returns errSegmentReleased in case the segment has already been
+// closed or unlinked and is no longer referenced.
+func (s *DataSegment) Acquire() error {
+	if !s.refs.acquire() {
+		return errSegmentReleased
+	}
+	s.mapMu.Lock()
+	var err error
+	mapped := false
+	if s.RawData == nil {
+		err = s.mapLocked()
+		mapped = err == nil
+	}
+	s.mapMu.Unlock()
+	if err != nil {
+		_ = s.Release()
+		return err
+	}
+	if mapped {
+		s.cache.enforce()
+	}
+	return nil
+}
+
+// Release drops a reference obtained through Acquire.
+func (s *DataSegment) Release() error {
+	if s.refs.release() {
+		return s.finalize()
+	}
+	s.cache.touch(s)
+	s.cache.enforce()
+	return nil
+}
+
+// Close flushes the segment to disk. Its memory is unmapped once all
+// references obtained through Acquire are released.
+func (s *DataSegment) Close() error {
+	s.mapMu.Lock()
+	var err error
+	if s.RawData != nil && !s.readOnly {
+		s.writeMu.Lock()
+		s.FlushMetadata()
+		err = s.File.Sync(0, int64(len(s.RawData)))
+		s.writeMu.Unlock()
+	}
+	s.mapMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.refs.releaseOwner() {
+		return s.finalize()
+	}
+	return nil
+}
+
+// fence prevents the segment from being flushed once closed or unmapped,
+// as another writer may have taken over the WAL and written to it.
+func (s *DataSegment) fence() {
+	s.mapMu.Lock()
+	s.readOnly = true
+	s.mapMu.Unlock()
+}
+
+// finalize unmaps the segment and closes its file.
+func (s *DataSegment) finalize() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+	if err := s.unmapLocked(false); err != nil {
 		return err
 	}
-	return s.File.Close()
+	s.refs.finishUnlink()
+	return nil
+}
+
+// seal marks the segment as no longer being written to, allowing it to be
+// unmapped once the mapping budget is exceeded.
+func (s *DataSegment) seal() {
+	s.sealed.Store(true)
+	s.cache.enforce()
+}
+
+// unseal maps the segment and prevents it from being unmapped, so it can be
+// written to.
+func (s *DataSegment) unseal() error {
+	s.sealed.Store(false)
+	if err := s.Acquire(); err != nil {
+		return err
+	}
+	return s.Release()
+}
+
+func (s *DataSegment) mappedSize() int64 { return s.Size + dataSegmentMetadataSize }
+
+func (s *DataSegment) evict() bool {
+	if !s.sealed.Load() || !s.mapMu.TryLock() {
+		return false
+	}
+	defer s.mapMu.Unlock()
+	// Segments released by their owner are only referenced by readers, and
+	// are unmapped once the last of them is released.
+	if s.RawData == nil || !s.refs.owned.Load() || s.refs.count.Load() != 1 {
+		return false
+	}
+	return s.unmapLocked(true) == nil
+}
+
+// mapLocked opens the segment's file through its store. Callers must hold
+// mapMu.
+func (s *DataSegment) mapLocked() error {
+	open := s.store.Open
+	if s.readOnly {
+		open = s.store.OpenReadOnly
+	}
+	file, err := open(s.name)
+	if err != nil {
+		return err
+	}
+	mapped := file.Bytes()
+	s.File = file
+	s.RawData = mapped
+	s.Metadata = mapped[:dataSegmentMetadataSize]
+	s.Records = mapped[dataSegmentMetadataSize:]
+	s.cache.mapped(s)
+	return nil
+}
+
+// unmapLocked unmaps the segment and closes its file, flushing its contents
+// first when flush is set. Callers must hold mapMu.
+func (s *DataSegment) unmapLocked(flush bool) error {
+	if s.RawData == nil {
+		return nil
+	}
+	if flush && !s.readOnly {
+		s.writeMu.Lock()
+		s.FlushMetadata()
+		s.dirty.take()
+		err := s.File.Sync(0, int64(len(s.RawData)))
+		s.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.File.Close(); err != nil {
+		return err
+	}
+	s.File, s.RawData, s.Metadata, s.Records = nil, nil, nil, nil
+	s.cache.unmapped(s)
+	return nil
 }
 
 func (s *DataSegment) AvailableSize() int64 { return s.Size - s.Cursor.Load() }
@@ -137,9 +350,17 @@ func (s *DataSegment) Available() bool {
 	return s.AvailableSize() > 0
 }
 
+// Unlink removes the segment from disk. Its file is removed right away, so
+// that a new segment may be created under the same id, while its memory
+// remains mapped until all references obtained through Acquire are released.
 func (s *DataSegment) Unlink() error {
-	if err := s.Close(); err != nil {
-		return err
+	s.refs.markUnlinked()
+	last := s.refs.releaseOwner()
+	err := s.store.Remove(s.name)
+	if last {
+		if finalizeErr := s.finalize(); err == nil {
+			err = finalizeErr
+		}
 	}
-	return os.Remove(s.Path)
+	return err
 }
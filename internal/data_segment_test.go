@@ -134,3 +134,50 @@ func TestDataSegmentRace(t *testing.T) {
 	assert.Equal(t, d1, read)
 	assert.False(t, seg.Available())
 }
+
+func TestDataSegmentSync(t *testing.T) {
+	cfg := NewDummyConfig(t)
+
+	seg, err := NewDataSegment(0, cfg)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, seg.Close()) }()
+
+	seg.Write(randomData(t, 16))
+	seg.Write(randomData(t, 8))
+	assert.Equal(t, dirtyRange{lo: 0, hi: 24}, seg.dirty)
+
+	require.NoError(t, seg.Sync())
+	assert.Equal(t, dirtyRange{}, seg.dirty)
+
+	seg.Write(randomData(t, 8))
+	assert.Equal(t, dirtyRange{lo: 24, hi: 32}, seg.dirty)
+}
+
+func TestDataSegmentDeferredUnlink(t *testing.T) {
+	cfg := NewDummyConfig(t)
+	seg, err := NewDataSegment(0, cfg)
+	require.NoError(t, err)
+	seg.Write([]byte("Hello, World!"))
+
+	// The file is removed right away, while its memory remains mapped for
+	// readers.
+	require.NoError(t, seg.Acquire())
+	before := segmentsPendingDeletion.Load()
+	require.NoError(t, seg.Unlink())
+	assert.NoFileExists(t, seg.Path)
+	assert.Equal(t, before+1, segmentsPendingDeletion.Load())
+	assert.Equal(t, []byte("Hello, World!"), seg.Bytes(0, 13))
+
+	// A new segment may be created under the same id meanwhile.
+	next, err := NewDataSegment(0, cfg)
+	require.NoError(t, err)
+	next.Write([]byte("Bye"))
+	assert.Equal(t, []byte("Hello, World!"), seg.Bytes(0, 13))
+
+	require.NoError(t, seg.Release())
+	assert.Equal(t, before, segmentsPendingDeletion.Load())
+	assert.Error(t, seg.Acquire())
+	assert.FileExists(t, next.Path)
+	assert.Equal(t, []byte("Bye"), next.Bytes(0, 3))
+	require.NoError(t, next.Close())
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"encoding/binary"
+	errs "errors"
+	"fmt"
+	"io/fs"
+	"sync/atomic"
+	"unsafe"
+)
+
+// epochFileName is the name of the file holding the WAL's epoch.
+const epochFileName = "epoch"
+
+// epochFileSize holds the size of the epoch file, which contains a single
+// big-endian integer.
+const epochFileSize = 8
+
+// epochFile holds the WAL's epoch, a counter incremented whenever a writer
+// opens the WAL. Writers compare their own epoch against it before every
+// write, so that a writer that lost its lock without noticing stops writing
+// once another writer takes over. The counter is accessed through the file's
+// memory for stores sharing it with other processes, such as MMapStore and
+// MemoryStore. Other stores, such as FileStore, have it read from the file
+// on every check instead.
+type epochFile struct {
+	file  SegmentFile
+	value *uint64
+
+	// store is set for stores unable to follow changes made to the file by
+	// other processes, and is used to read the epoch from the file.
+	store SegmentStore
+}
+
+// openEpochFile opens the epoch file kept by a given store, creating it when
+// it does not exist.
+func openEpochFile(store SegmentStore) (*epochFile, error) {
+	if err := store.Create(epochFileName, epochFileSize); err == nil {
+		if err = store.Sync(); err != nil {
+			return nil, err
+		}
+	} else if !errs.Is(err, fs.ErrExist) {
+		return nil, err
+	}
+
+	file, err := store.Open(epochFileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Bytes()) < epochFileSize {
+		_ = file.Close()
+		return nil, fmt.Errorf("invalid epoch file")
+	}
+	e := &epochFile{
+		file:  file,
+		value: (*uint64)(unsafe.Pointer(&file.Bytes()[0])),
+	}
+	if !store.SharesChanges() {
+		e.store = store
+	}
+	return e, nil
+}
+
+// readEpoch reads the current epoch from the epoch file kept by a given
+// store, without opening it. Returns zero in case no writer ever opened the
+// WAL.
+func readEpoch(store SegmentStore) (int64, error) {
+	b := make([]byte, epochFileSize)
+	err := store.ReadAt(epochFileName, b, 0)
+	if errs.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(be.Uint64(b)), nil
+}
+
+// load returns the current epoch.
+func (e *epochFile) load() (int64, error) {
+	if e.store != nil {
+		return readEpoch(e.store)
+	}
+	var b [8]byte
+	binary.NativeEndian.PutUint64(b[:], atomic.LoadUint64(e.value))
+	return int64(be.Uint64(b[:])), nil
+}
+
+// advance increments the epoch, persisting it before returning the new
+// value.
+func (e *epochFile) advance() (int64, error) {
+	current, err := e.load()
+	if err != nil {
+		return 0, err
+	}
+	epoch := current + 1
+	var b [8]byte
+	be.PutUint64(b[:], uint64(epoch))
+	atomic.StoreUint64(e.value, binary.NativeEndian.Uint64(b[:]))
+	e.file.Flush(0, epochFileSize)
+	if err = e.file.Sync(0, epochFileSize); err != nil {
+		return 0, err
+	}
+	return epoch, nil
+}
+
+// Close closes the epoch file.
+func (e *epochFile) Close() error {
+	return e.file.Close()
+}
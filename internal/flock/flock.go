@@ -38,7 +38,13 @@ type Flock interface {
 	// in case the lock cannot be acquired.
 	Lock() error
 
-	// Unlock releases the lock acquired by calling Lock. Returns NotLockedErr
+	// LockShared attempts to obtain a shared lock on the file managed by this
+	// instance. Shared locks may be held by several instances at once, but
+	// not while an exclusive lock obtained through Lock is held. Returns the
+	// same errors as Lock.
+	LockShared() error
+
+	// Unlock releases the lock acquired by calling Lock or LockShared. Returns NotLockedErr
 	// in case the lock is not currently held, or ClosedErr in case Close has
 	// already been called on this instance.
 	Unlock() error
@@ -52,7 +58,8 @@ type Flock interface {
 
 	// Remove automatically releases the lock (in case it is currently being
 	// held by this instance), closes the underlying file descriptor, and
-	// removes it from the filesystem. After calling this method, no further
+	// removes it from the filesystem, unless it has been replaced by another
+	// file under the same path. After calling this method, no further
 	// operations can be done against the instance; To recreate the filesystem
 	// node and reacquire the lock, create a new Flock instance by calling New.
 	Remove() error
@@ -79,6 +86,18 @@ func New(path string) (Flock, error) {
 	return &flock{file: f, fd: f.Fd(), name: path}, nil
 }
 
+// Open returns a new Flock instance for an existing file at a given path,
+// opened for reading only. Such instances may only obtain shared locks, and
+// cannot be written to.
+// Returns an error in case the file cannot be opened.
+func Open(path string) (Flock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &flock{file: f, fd: f.Fd(), name: path}, nil
+}
+
 type flock struct {
 	mu     sync.Mutex
 	file   *os.File
@@ -89,6 +108,14 @@ type flock struct {
 }
 
 func (f *flock) Lock() error {
+	return f.lock(syscall.LOCK_EX)
+}
+
+func (f *flock) LockShared() error {
+	return f.lock(syscall.LOCK_SH)
+}
+
+func (f *flock) lock(how int) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -99,7 +126,13 @@ func (f *flock) Lock() error {
 		return AlreadyLockedErr
 	}
 
-	err := syscall.Flock(int(f.fd), syscall.LOCK_EX|syscall.LOCK_NB)
+	err := syscall.Flock(int(f.fd), how|syscall.LOCK_NB)
+	if err == nil && f.stale() {
+		// The file was removed by its previous holder after being opened, and
+		// another instance may lock a new file under the same path.
+		_ = syscall.Flock(int(f.fd), syscall.LOCK_UN)
+		err = fmt.Errorf("%s has been removed", f.name)
+	}
 	if err == nil {
 		f.locked = true
 	} else {
@@ -108,6 +141,17 @@ func (f *flock) Lock() error {
 	return err
 }
 
+// stale returns whether the file opened by this instance is no longer the
+// one present under its path.
+func (f *flock) stale() bool {
+	opened, err := f.file.Stat()
+	if err != nil {
+		return true
+	}
+	current, err := os.Stat(f.name)
+	return err != nil || !os.SameFile(opened, current)
+}
+
 func (f *flock) Unlock() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -159,10 +203,15 @@ func (f *flock) close() error {
 func (f *flock) Remove() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	stale := !f.closed && f.stale()
 	if err := f.close(); err != nil && !errors.Is(err, os.ErrClosed) {
 		return err
 	}
 
+	if stale {
+		// The file now belongs to another instance.
+		return nil
+	}
 	if err := os.Remove(f.name); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -176,6 +225,9 @@ func (f *flock) Write(data []byte) error {
 	if _, err := f.file.WriteAt(data, 0); err != nil {
 		return err
 	}
+	if err := f.file.Truncate(int64(len(data))); err != nil {
+		return err
+	}
 	return f.file.Sync()
 }
 
@@ -1,6 +1,8 @@
 package flock
 
 import (
+	"io"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -115,6 +117,92 @@ func TestFlock(t *testing.T) {
 		require.ErrorIs(t, err, ClosedErr)
 	})
 
+	t.Run("Shared lock", func(t *testing.T) {
+		path := makePath(t)
+		f := makeLockAt(t, path)
+		_, err := Open(filepath.Join(t.TempDir(), "missing"))
+		require.Error(t, err)
+
+		r1, err := Open(path)
+		require.NoError(t, err)
+		r2, err := Open(path)
+		require.NoError(t, err)
+
+		err = f.Lock()
+		require.NoError(t, err)
+		err = r1.LockShared()
+		require.ErrorIs(t, err, CannotLockErr)
+
+		err = f.Unlock()
+		require.NoError(t, err)
+		err = r1.LockShared()
+		require.NoError(t, err)
+		err = r2.LockShared()
+		require.NoError(t, err)
+		err = f.Lock()
+		require.ErrorIs(t, err, CannotLockErr)
+		err = r1.Write([]byte("data"))
+		require.Error(t, err)
+
+		require.NoError(t, r1.Close())
+		require.NoError(t, r2.Close())
+		err = f.Lock()
+		require.NoError(t, err)
+		err = f.Close()
+		require.NoError(t, err)
+	})
+
+	t.Run("Lock after removal", func(t *testing.T) {
+		path := makePath(t)
+		f := makeLockAt(t, path)
+		f2 := makeLockAt(t, path)
+
+		err := f.Lock()
+		require.NoError(t, err)
+		err = f.Remove()
+		require.NoError(t, err)
+
+		err = f2.Lock()
+		require.ErrorIs(t, err, CannotLockErr)
+		err = f2.Close()
+		require.NoError(t, err)
+	})
+
+	t.Run("Remove after replacement", func(t *testing.T) {
+		path := makePath(t)
+		f := makeLockAt(t, path)
+		err := f.Lock()
+		require.NoError(t, err)
+
+		err = os.Remove(path)
+		require.NoError(t, err)
+		f2 := makeLockAt(t, path)
+		err = f2.Lock()
+		require.NoError(t, err)
+
+		err = f.Remove()
+		require.NoError(t, err)
+		require.FileExists(t, path)
+		err = f2.Remove()
+		require.NoError(t, err)
+		require.NoFileExists(t, path)
+	})
+
+	t.Run("Write replaces contents", func(t *testing.T) {
+		f := makeLock(t)
+		err := f.Write([]byte("longer contents"))
+		require.NoError(t, err)
+		err = f.Write([]byte("short"))
+		require.NoError(t, err)
+
+		data := make([]byte, 32)
+		n, err := f.Read(data)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, "short", string(data[:n]))
+		err = f.Close()
+		require.NoError(t, err)
+	})
+
 	t.Run("Recreate after close", func(t *testing.T) {
 		p := makePath(t)
 		f := makeLockAt(t, p)
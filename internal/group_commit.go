@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/heyvito/wal/errors"
+	"github.com/heyvito/wal/internal/metrics"
+)
+
+type appendRequest struct {
+	data []byte
+	rec  *IndexRecord
+	done chan error
+}
+
+// groupCommitter collects concurrent appends into batches, so that a single
+// lock acquisition and a single sync cover every append in a batch.
+type groupCommitter struct {
+	index    *Index
+	maxBatch int
+	linger   time.Duration
+	requests chan *appendRequest
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newGroupCommitter(index *Index, maxBatch int, linger time.Duration) *groupCommitter {
+	c := &groupCommitter{
+		index:    index,
+		maxBatch: maxBatch,
+		linger:   linger,
+		requests: make(chan *appendRequest),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Append enqueues data to be written in the next batch, and blocks until the
+// batch containing it has been committed.
+func (c *groupCommitter) Append(data []byte, rec *IndexRecord) error {
+	req := &appendRequest{data: data, rec: rec, done: make(chan error, 1)}
+	select {
+	case c.requests <- req:
+	case <-c.stop:
+		return errors.ErrClosed
+	}
+	return <-req.done
+}
+
+// Close stops accepting new appends and waits for the batch in progress, if
+// any, to be committed.
+func (c *groupCommitter) Close() {
+	close(c.stop)
+	<-c.stopped
+}
+
+func (c *groupCommitter) run() {
+	defer close(c.stopped)
+	batch := make([]*appendRequest, 0, c.maxBatch)
+	var timer *time.Timer
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case req := <-c.requests:
+			batch = append(batch[:0], req)
+		}
+
+		var expired <-chan time.Time
+		if c.linger > 0 {
+			if timer == nil {
+				timer = time.NewTimer(c.linger)
+			} else {
+				timer.Reset(c.linger)
+			}
+			expired = timer.C
+		}
+
+	collect:
+		for len(batch) < c.maxBatch {
+			if expired == nil {
+				select {
+				case req := <-c.requests:
+					batch = append(batch, req)
+				default:
+					break collect
+				}
+				continue
+			}
+			select {
+			case req := <-c.requests:
+				batch = append(batch, req)
+			case <-expired:
+				break collect
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		c.index.commitBatch(batch)
+		clear(batch)
+	}
+}
+
+// commitBatch writes all requests of a batch under a single acquisition of
+// writeMu, syncs and publishes them at once according to the sync policy,
+// and releases every waiting caller.
+func (i *Index) commitBatch(batch []*appendRequest) {
+	metrics.Simple(metrics.IndexGroupCommitBatchSize, float64(len(batch)))
+
+	i.writeMu.Lock()
+	errs := make([]error, len(batch))
+	for n, req := range batch {
+		errs[n] = i.appendLocked(req.data, req.rec)
+	}
+	syncErr := i.commitLocked()
+	i.writeMu.Unlock()
+
+	for n, req := range batch {
+		if errs[n] == nil {
+			errs[n] = syncErr
+		}
+		req.done <- errs[n]
+	}
+}
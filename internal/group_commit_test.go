@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommitConcurrentAppends(t *testing.T) {
+	conf := NewDummyConfig(t,
+		WithSyncPolicy(SyncPolicy{Mode: SyncModeEveryWrite}),
+		WithGroupCommit(8, time.Millisecond),
+	)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	const writers = 32
+	payloads := make([][]byte, writers)
+	records := make([]*IndexRecord, writers)
+	errs := make([]error, writers)
+	wg := sync.WaitGroup{}
+	for n := range writers {
+		payloads[n] = randomData(t, 8)
+		records[n] = &IndexRecord{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[n] = idx.Append(payloads[n], records[n])
+		}()
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{}
+	for n := range writers {
+		require.NoError(t, errs[n])
+		assert.False(t, seen[records[n].RecordID], "record ID %d assigned twice", records[n].RecordID)
+		seen[records[n].RecordID] = true
+
+		rec := &IndexRecord{}
+		require.NoError(t, idx.LookupMeta(records[n].RecordID, rec))
+		r, err := idx.ReadRecord(rec)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, payloads[n], data)
+	}
+	assert.Equal(t, int64(writers-1), idx.MaxRecord.Load())
+}
+
+func TestGroupCommitAppendAfterClose(t *testing.T) {
+	conf := NewDummyConfig(t, WithGroupCommit(4, 0))
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	committer := idx.committer
+	require.NoError(t, idx.Close())
+	assert.Error(t, committer.Append(randomData(t, 8), &IndexRecord{}))
+}
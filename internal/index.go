@@ -1,15 +1,13 @@
 package internal
 
 import (
+	errs "errors"
 	"fmt"
 	"github.com/heyvito/wal/internal/metrics"
 	"io"
+	"io/fs"
 	"math"
 	"os"
-	"path/filepath"
-	"slices"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +16,10 @@ import (
 	"github.com/heyvito/wal/errors"
 )
 
+// readOnlyRefreshInterval determines how often read-only indexes re-read
+// segment metadata in order to follow the process writing to the WAL.
+const readOnlyRefreshInterval = 100 * time.Millisecond
+
 type Index struct {
 	Config         Config
 	Workdir        string
@@ -29,17 +31,63 @@ type Index struct {
 	CurrentSegment *IndexSegment
 	log            stdlog.Logger
 
-	dm *DataManager
+	dm    *DataManager
+	cache *segmentCache
+	store SegmentStore
+
+	writeMu  sync.Mutex
+	unsynced []*IndexSegment
 
-	writeMu sync.Mutex
+	// written holds the id of the last record written to the index. Records
+	// are only published through MaxRecord once synced as required by the
+	// sync policy. unsyncedDir indicates whether segments were created since
+	// the last sync, and syncErr holds the error of a failed sync that left
+	// records unpublished. Guarded by writeMu.
+	written     int64
+	unsyncedDir bool
+	syncErr     error
+
+	// stream holds the ObjectWriter currently streaming into the data
+	// manager, if any. Guarded by writeMu.
+	stream *ObjectWriter
 
 	measureUsageTimer *time.Ticker
+	syncPolicy        SyncPolicy
+	stopSync          chan struct{}
+	syncStopped       chan struct{}
+	committer         *groupCommitter
+	closed            atomic.Bool
+	appended          appendNotifier
+
+	snapshotsMu sync.Mutex
+	snapshots   map[*snapshot]struct{}
+
+	// table holds the segments sorted by record ids, and is swapped by
+	// publishSegments whenever segments are created or removed.
+	table atomic.Pointer[segmentTable]
+
+	// loaded indicates whether the index finished loading, in which case a
+	// manifest is written once it is closed.
+	loaded bool
+
+	// epochFile holds the WAL's current epoch, and epoch the one obtained
+	// when this index opened the WAL for writing.
+	epochFile *epochFile
+	epoch     int64
+
+	// readOnly indicates whether the index follows segments written by
+	// another process, refreshing them periodically, instead of writing to
+	// them.
+	readOnly       bool
+	stopRefresh    chan struct{}
+	refreshStopped chan struct{}
 }
 
 func NewIndex(config Config) (*Index, error) {
 	wd := config.GetWorkdir()
+	readOnly := config.GetReadOnly()
 	stat, err := os.Stat(wd)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && !readOnly {
 		if err = os.MkdirAll(wd, 0755); err != nil {
 			return nil, err
 		}
@@ -51,80 +99,211 @@ func NewIndex(config Config) (*Index, error) {
 
 	log := config.GetLogger().Named("index")
 
+	store := config.GetStore()
+	man, err := readManifest(store)
+	if err != nil {
+		log.Warning("Ignoring invalid manifest", "error", err)
+		man = nil
+	}
+
+	cache := newSegmentCache(config)
 	done := metrics.Measure(metrics.CommonDataManagerInitializationTiming)
-	dm, err := NewDataManager(config)
+	dm, err := newDataManager(config, cache, man)
 	if err != nil {
 		metrics.Simple(metrics.CommonDataManagerInitializationFailures, 0)
 		return nil, fmt.Errorf("failed starting data manager: %w", err)
 	}
 	done()
 
-	var segmentsToLoad []int64
-	entries, err := os.ReadDir(wd)
+	segmentsToLoad, err := listSegments(store, indexSegmentPrefix, log)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		if !strings.HasPrefix(entry.Name(), "index") {
-			continue
-		}
-		id, err := strconv.ParseInt(entry.Name()[5:], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("%s: invalid index file name: %w", entry.Name(), err)
-		}
-		segmentsToLoad = append(segmentsToLoad, id)
-	}
-
 	log.Info("Loading index segments", "size", len(segmentsToLoad))
-	slices.Sort(segmentsToLoad)
 
 	i := &Index{
 		Config:         config,
 		Workdir:        wd,
+		store:          store,
 		CurrentSegment: nil,
 		log:            log,
 		dm:             dm,
+		cache:          cache,
+		syncPolicy:     config.GetSyncPolicy(),
+		readOnly:       readOnly,
 	}
 
 	i.MinSegment.Store(-1)
 	i.MaxSegment.Store(-1)
+	i.MaxRecord.Store(config.GetFirstRecordID() - 1)
 
-	for _, id := range segmentsToLoad {
-		segment, err := NewIndexSegment(id, config)
+	// Every writer opening the WAL starts a new epoch, fencing out writers
+	// that opened it before.
+	if !readOnly {
+		if i.epochFile, err = openEpochFile(store); err == nil {
+			i.epoch, err = i.epochFile.advance()
+		}
 		if err != nil {
 			_ = i.Close()
-			log.Error(err, "Failed loading index segment", "id", id)
+			log.Error(err, "Failed advancing epoch")
 			return nil, err
 		}
-		if ms := i.MinSegment.Load(); id < ms || ms == -1 {
-			i.MinSegment.Store(id)
+	}
+
+	// Segments described by the manifest are loaded without being opened.
+	// The last segment is always read from disk, as it is written to.
+	segments, err := loadSegments(segmentsToLoad, func(id int64) (*IndexSegment, error) {
+		if entry, ok := man.indexEntry(id); ok && id != segmentsToLoad[len(segmentsToLoad)-1] {
+			return indexSegmentFromManifest(entry, config, cache), nil
+		}
+		segment, err := openIndexSegment(id, 0, 0, config, cache, true)
+		if err != nil {
+			log.Error(err, "Failed loading index segment", "id", id)
 		}
+		return segment, err
+	})
+	if err != nil {
+		_ = i.Close()
+		return nil, err
+	}
+
+	for n, segment := range segments {
+		id := segmentsToLoad[n]
 		i.Segments.Store(id, segment)
 		i.LoadedSegments.Add(1)
-		log.Debug("Loaded index segment", "id", segment.SegmentID)
+		log.Debug("Loaded index segment", "id", id)
 		if i.CurrentSegment == nil || id > i.CurrentSegment.SegmentID {
 			i.CurrentSegment = segment
-			i.MaxRecord.Store(segment.UpperRecord.Load())
+			i.MaxRecord.Store(segment.LastRecordID())
 			i.MaxSegment.Store(segment.SegmentID)
 		}
 	}
 
+	// The manifest is only valid until segments are changed, and must not
+	// outlive this process in case it does not shut down cleanly. Read-only
+	// indexes leave it to the next writer.
+	if !readOnly {
+		if err = removeManifest(store); err != nil {
+			_ = i.Close()
+			log.Error(err, "Failed removing manifest")
+			return nil, err
+		}
+	}
+
+	// Segments marked as purged are left behind by vacuums that were
+	// interrupted, or whose removal was deferred by snapshots. Read-only
+	// indexes only stop tracking them.
+	for id, segment := range i.Segments.Range() {
+		if !segment.Purged || segment == i.CurrentSegment {
+			continue
+		}
+		if readOnly {
+			err = i.dropSegment(segment)
+		} else {
+			log.Info("Removing purged index segment", "id", id)
+			err = i.unlinkSegment(segment)
+		}
+		if err != nil {
+			_ = i.Close()
+			return nil, err
+		}
+	}
+	for id := range i.Segments.Range() {
+		if ms := i.MinSegment.Load(); id < ms || ms == -1 {
+			i.MinSegment.Store(id)
+		}
+	}
+	i.publishSegments()
+
+	if readOnly {
+		i.stopRefresh = make(chan struct{})
+		i.refreshStopped = make(chan struct{})
+		go i.refreshPeriodically(readOnlyRefreshInterval, i.stopRefresh, i.refreshStopped)
+		return i, nil
+	}
+
+	i.written = i.MaxRecord.Load()
 	if len(segmentsToLoad) == 0 {
 		if err = i.Rotate(); err != nil {
+			_ = i.Close()
+			log.Error(err, "Failed creating index segment")
 			return nil, err
 		}
+	} else if err = i.CurrentSegment.unseal(); err != nil {
+		_ = i.Close()
+		log.Error(err, "Failed mapping index segment", "id", i.CurrentSegment.SegmentID)
+		return nil, err
+	} else {
+		i.stampCurrentSegment()
+	}
+
+	if err = i.recoverData(); err != nil {
+		_ = i.Close()
+		log.Error(err, "Failed recovering data segments")
+		return nil, err
 	}
 
+	i.loaded = true
 	i.measureUsageTimer = time.NewTicker(10 * time.Second)
 	go i.measureUsage()
+
+	if maxBatch := config.GetGroupCommitMaxBatch(); maxBatch > 1 {
+		i.committer = newGroupCommitter(i, maxBatch, config.GetGroupCommitMaxLinger())
+	}
+
+	if i.syncPolicy.Mode == SyncModeInterval {
+		i.stopSync = make(chan struct{})
+		i.syncStopped = make(chan struct{})
+		go i.syncPeriodically(i.syncPolicy.Interval, i.stopSync, i.syncStopped)
+	}
 	return i, nil
 }
 
+// recoverData rewinds the data manager to the end of the last committed
+// record holding any data, discarding bytes written by appends that never
+// reached the index. Records that cannot be read fail recovery, instead of
+// being skipped, as that would discard the data they point to.
+func (i *Index) recoverData() error {
+	rec := &IndexRecord{}
+	for id := i.MaxRecord.Load(); id >= 0 && id >= i.MinimumRecordID(); id-- {
+		if err := i.LookupMeta(id, rec); errs.As(err, &errors.NotFound{}) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if rec.Size > 0 {
+			return i.dm.Recover(rec)
+		}
+	}
+	return i.dm.Recover(nil)
+}
+
 func (i *Index) Close() error {
+	// Setting closed under writeMu ensures writes either finished before, or
+	// observe it once they acquire writeMu.
+	i.writeMu.Lock()
+	i.closed.Store(true)
+	i.writeMu.Unlock()
+	i.appended.close()
+	i.abortStream()
+
+	if i.committer != nil {
+		i.committer.Close()
+	}
+
+	if i.stopSync != nil {
+		close(i.stopSync)
+		<-i.syncStopped
+		i.stopSync = nil
+	}
+
+	if i.stopRefresh != nil {
+		close(i.stopRefresh)
+		<-i.refreshStopped
+		i.stopRefresh = nil
+	}
+
 	i.writeMu.Lock()
 	defer i.writeMu.Unlock()
 
@@ -132,6 +311,18 @@ func (i *Index) Close() error {
 		i.measureUsageTimer.Stop()
 	}
 
+	// Segments of an index fenced out by another writer are closed without
+	// being flushed, as that would overwrite changes made by that writer.
+	staleErr := i.checkEpoch()
+	if staleErr != nil {
+		for _, seg := range i.Segments.Range() {
+			seg.fence()
+		}
+		for _, seg := range i.dm.Segments.Range() {
+			seg.fence()
+		}
+	}
+
 	if i.dm != nil {
 		done := metrics.Measure(metrics.CommonCloseDataManagerTiming)
 		if err := i.dm.Close(); err != nil {
@@ -149,24 +340,94 @@ func (i *Index) Close() error {
 		}
 	}
 
+	if i.loaded {
+		i.loaded = false
+		if staleErr != nil {
+			// The manifest is owned by the writer that took over.
+			i.log.Warning("Skipping manifest", "error", staleErr)
+			return i.closeEpochFile()
+		}
+		var indexSegs []*IndexSegment
+		for _, seg := range i.Segments.Range() {
+			indexSegs = append(indexSegs, seg)
+		}
+		var dataSegs []*DataSegment
+		for _, seg := range i.dm.Segments.Range() {
+			dataSegs = append(dataSegs, seg)
+		}
+		if err := writeManifest(i.store, indexSegs, dataSegs); err != nil {
+			// The manifest only speeds up loading, which falls back to
+			// reading segment headers in its absence.
+			i.log.Warning("Failed writing manifest", "error", err)
+		}
+	}
+
+	return i.closeEpochFile()
+}
+
+func (i *Index) closeEpochFile() error {
+	if i.epochFile == nil {
+		return nil
+	}
+	err := i.epochFile.Close()
+	i.epochFile = nil
+	return err
+}
+
+// Epoch returns the epoch started when the index opened the WAL for writing.
+// Read-only indexes return the epoch of the last writer that opened the WAL.
+func (i *Index) Epoch() int64 {
+	if !i.readOnly {
+		return i.epoch
+	}
+	epoch, err := readEpoch(i.store)
+	if err != nil {
+		i.log.Warning("Failed reading epoch", "error", err)
+	}
+	return epoch
+}
+
+// checkEpoch returns a StaleEpochError in case another writer opened the WAL
+// after this index did, in which case the index must not write to it again.
+// Read-only indexes are never stale.
+func (i *Index) checkEpoch() error {
+	if i.epochFile == nil {
+		return nil
+	}
+	current, err := i.epochFile.load()
+	if err != nil {
+		return err
+	}
+	if current != i.epoch {
+		return errors.StaleEpochError{Epoch: i.epoch, Current: current}
+	}
 	return nil
 }
 
+// stampCurrentSegment records the index's epoch in the header of the segment
+// receiving new records. Callers must hold writeMu, or have exclusive access
+// to the index.
+func (i *Index) stampCurrentSegment() {
+	i.CurrentSegment.stampEpoch(i.epoch)
+	i.markUnsynced(i.CurrentSegment)
+}
+
 func (i *Index) Rotate() error {
 	var seg *IndexSegment
 	var err error
+	base := i.written + 1
+	prev := i.CurrentSegment
 	if i.CurrentSegment == nil {
-		seg, err = NewIndexSegment(0, i.Config)
+		seg, err = openIndexSegment(0, base, i.epoch, i.Config, i.cache, false)
 		if err != nil {
 			return err
 		}
 		i.MinSegment.Store(0)
 		i.MaxSegment.Store(0)
 		i.Segments.Store(0, seg)
-		i.MaxRecord.Store(-1)
 		i.CurrentSegment = seg
 	} else {
-		seg, err = NewIndexSegment(i.CurrentSegment.SegmentID+1, i.Config)
+		seg, err = openIndexSegment(i.CurrentSegment.SegmentID+1, base, i.epoch, i.Config, i.cache, false)
 		if err != nil {
 			return err
 		}
@@ -174,53 +435,403 @@ func (i *Index) Rotate() error {
 		i.Segments.Store(seg.SegmentID, seg)
 		i.MaxSegment.Store(seg.SegmentID)
 	}
+	i.unsyncedDir = true
 	i.LoadedSegments.Add(1)
+	i.publishSegments()
+	if prev != nil {
+		prev.seal()
+	} else {
+		i.cache.enforce()
+	}
 	return nil
 }
 
 func (i *Index) Append(data []byte, rec *IndexRecord) error {
-	i.writeMu.Lock()
-	defer i.writeMu.Unlock()
 	defer metrics.Measure(metrics.IndexAppendLatency)()
 	metrics.Simple(metrics.IndexAppendCalls, 0)
 
+	if i.readOnly {
+		return errors.ErrReadOnly
+	}
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	if i.committer != nil {
+		return i.committer.Append(data, rec)
+	}
+
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+
+	if err := i.appendLocked(data, rec); err != nil {
+		return err
+	}
+	return i.commitLocked()
+}
+
+// appendLocked writes data and its index record without syncing or
+// publishing them. Callers must hold writeMu.
+func (i *Index) appendLocked(data []byte, rec *IndexRecord) error {
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	if err := i.waitStreamLocked(); err != nil {
+		return err
+	}
+	if err := i.checkEpoch(); err != nil {
+		return err
+	}
+	if i.syncErr != nil {
+		return i.syncErr
+	}
 	if !i.CurrentSegment.FitsRecord() {
 		if err := i.Rotate(); err != nil {
 			return err
 		}
 	}
 
-	recID := i.MaxRecord.Load() + 1
+	recID := i.written + 1
 	rec.RecordID = recID
 	rec.Size = int64(len(data))
 	rec.Purged = false
+	rec.Checksum = Checksum(data)
+	rec.Checksummed = true
 
 	if err := i.dm.Write(data, rec); err != nil {
 		return err
 	}
 
-	i.MaxRecord.Store(recID)
-
 	i.CurrentSegment.WriteRecord(rec)
+	i.written = recID
+	i.markUnsynced(i.CurrentSegment)
 	return nil
 }
 
-func (i *Index) SegmentForID(id int64) (*IndexSegment, bool) {
-	for _, seg := range i.Segments.Range() {
-		if seg.ContainsRecord(id) {
-			return seg, true
+// commitLocked publishes the records written since it was last called, once
+// synced as required by the sync policy. In case syncing fails, records are
+// left unpublished, and further writes fail with the same error, as whether
+// they reached stable storage cannot be determined. Callers must hold
+// writeMu.
+func (i *Index) commitLocked() error {
+	if i.syncPolicy.Mode == SyncModeEveryWrite {
+		if err := i.syncLocked(); err != nil {
+			i.syncErr = err
+			return err
+		}
+	}
+	if i.MaxRecord.Load() != i.written {
+		i.MaxRecord.Store(i.written)
+		i.appended.notify()
+	}
+	return nil
+}
+
+// AppendBatch writes a sequence of objects under contiguous record ids. All
+// data is written before any index record is published, and records become
+// visible at once, so that either all objects survive a crash, or none do.
+// Likewise, data written before a failed write is discarded. recs must have
+// the same length as data.
+func (i *Index) AppendBatch(data [][]byte, recs []*IndexRecord) error {
+	if i.readOnly {
+		return errors.ErrReadOnly
+	}
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	defer metrics.Measure(metrics.IndexAppendBatchLatency)()
+	metrics.Simple(metrics.IndexAppendBatchCalls, 0)
+
+	if err := i.waitStreamLocked(); err != nil {
+		return err
+	}
+	if err := i.checkEpoch(); err != nil {
+		return err
+	}
+	if i.syncErr != nil {
+		return i.syncErr
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if !i.CurrentSegment.FitsRecords(len(data)) {
+		if limit := i.Config.GetIndexSegmentSize() / IndexRecordSize; int64(len(data)) > limit {
+			return errors.BatchTooLargeError{Objects: len(data), Limit: limit}
+		}
+		if err := i.Rotate(); err != nil {
+			return err
+		}
+	}
+
+	var start IndexRecord
+	if err := i.dm.Begin(&start); err != nil {
+		return err
+	}
+	nextID := i.written + 1
+	for n, obj := range data {
+		rec := recs[n]
+		rec.RecordID = nextID + int64(n)
+		rec.Size = int64(len(obj))
+		rec.Purged = false
+		rec.Checksum = Checksum(obj)
+		rec.Checksummed = true
+		if err := i.dm.Write(obj, rec); err != nil {
+			if rewindErr := i.dm.Rewind(&start); rewindErr != nil {
+				return errs.Join(err, rewindErr)
+			}
+			return err
+		}
+	}
+
+	i.CurrentSegment.WriteRecords(recs)
+	i.written = recs[len(recs)-1].RecordID
+	i.markUnsynced(i.CurrentSegment)
+	return i.commitLocked()
+}
+
+func (i *Index) markUnsynced(seg *IndexSegment) {
+	if n := len(i.unsynced); n > 0 && i.unsynced[n-1] == seg {
+		return
+	}
+	i.unsynced = append(i.unsynced, seg)
+}
+
+// Sync flushes all data and index records written since the last call to
+// Sync to stable storage.
+func (i *Index) Sync() error {
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	return i.syncLocked()
+}
+
+// syncLocked flushes data segments before index segments, so that no index
+// record reaches stable storage before the data it points to, followed by the
+// directory entries of segments created since the last sync. Callers must
+// hold writeMu.
+func (i *Index) syncLocked() error {
+	metrics.Simple(metrics.IndexSyncCalls, 0)
+	defer metrics.Measure(metrics.IndexSyncLatency)()
+
+	if err := i.dm.Sync(); err != nil {
+		return err
+	}
+
+	for len(i.unsynced) > 0 {
+		seg := i.unsynced[0]
+		if cur, ok := i.Segments.Load(seg.SegmentID); ok && cur == seg {
+			if err := seg.Sync(); err != nil {
+				return err
+			}
+		}
+		i.unsynced = i.unsynced[1:]
+	}
+	i.unsynced = nil
+
+	if i.unsyncedDir {
+		if err := i.store.Sync(); err != nil {
+			return err
+		}
+		i.unsyncedDir = false
+	}
+	return nil
+}
+
+func (i *Index) syncPeriodically(interval time.Duration, stop <-chan struct{}, stopped chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(stopped)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := i.Sync(); err != nil && err != errors.ErrClosed {
+				i.log.Error(err, "Periodic sync failed")
+			}
+		}
+	}
+}
+
+// Refresh picks up changes made to the WAL by the process writing to it:
+// records appended to known segments, segments it created, and segments it
+// purged or removed. Only the newest and oldest segments have their metadata
+// re-read, as the writer only appends to the former, and vacuums starting
+// from the latter. Read-only indexes are refreshed periodically; calling
+// Refresh makes changes visible immediately. Does nothing on writable
+// indexes.
+func (i *Index) Refresh() error {
+	if !i.readOnly {
+		return nil
+	}
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	defer i.publishSegments()
+
+	// Data segments are refreshed first, so that records picked up below
+	// never point to data segments that are not loaded yet.
+	if err := i.dm.refresh(); err != nil {
+		return err
+	}
+
+	ids, err := listSegments(i.store, indexSegmentPrefix, i.log)
+	if err != nil {
+		return err
+	}
+	present := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+
+	// fresh holds segments whose metadata has been read during this call.
+	fresh := map[int64]bool{}
+	refresh := func(seg *IndexSegment) error {
+		if fresh[seg.SegmentID] {
+			return nil
+		}
+		err := seg.refresh()
+		if errs.Is(err, fs.ErrNotExist) {
+			// Removed by the writer since being listed.
+			return i.dropSegment(seg)
+		}
+		fresh[seg.SegmentID] = true
+		return err
+	}
+
+	lastKnown := int64(-1)
+	for id, seg := range i.Segments.Range() {
+		if !present[id] {
+			if err = i.dropSegment(seg); err != nil {
+				return err
+			}
+		} else if id > lastKnown {
+			lastKnown = id
+		}
+	}
+	if seg, ok := i.Segments.Load(lastKnown); ok {
+		if err = refresh(seg); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if _, ok := i.Segments.Load(id); ok {
+			continue
+		}
+		seg, err := openIndexSegment(id, 0, 0, i.Config, i.cache, true)
+		if errs.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		i.Segments.Store(id, seg)
+		i.LoadedSegments.Add(1)
+		fresh[id] = true
+	}
+
+	// The writer marks segments as purged from the oldest to the newest, and
+	// may defer their removal while snapshots are held. The newest segment
+	// is never purged.
+	for {
+		oldest, newest := i.segmentBounds()
+		seg, ok := i.Segments.Load(oldest)
+		if !ok || oldest == newest {
+			break
+		}
+		if err = refresh(seg); err != nil {
+			return err
+		}
+		if cur, ok := i.Segments.Load(oldest); !ok {
+			continue
+		} else if !cur.Purged {
+			break
+		}
+		if err = i.dropSegment(seg); err != nil {
+			return err
+		}
+	}
+
+	oldest, newest := i.segmentBounds()
+	i.MinSegment.Store(oldest)
+	i.MaxSegment.Store(newest)
+	i.CurrentSegment, _ = i.Segments.Load(newest)
+
+	maxRecord := i.Config.GetFirstRecordID() - 1
+	if i.CurrentSegment != nil {
+		maxRecord = i.CurrentSegment.LastRecordID()
+	}
+	if i.MaxRecord.Swap(maxRecord) != maxRecord {
+		i.appended.notify()
+	}
+	return nil
+}
+
+// segmentBounds returns the ids of the oldest and newest segments, or -1
+// for both in case there are no segments.
+func (i *Index) segmentBounds() (oldest, newest int64) {
+	oldest, newest = -1, -1
+	for id := range i.Segments.Range() {
+		if oldest == -1 || id < oldest {
+			oldest = id
+		}
+		if id > newest {
+			newest = id
 		}
 	}
-	return nil, false
+	return oldest, newest
+}
+
+// refreshPeriodically calls Refresh every interval, until stop is closed.
+func (i *Index) refreshPeriodically(interval time.Duration, stop <-chan struct{}, stopped chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(stopped)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := i.Refresh(); err != nil {
+				i.log.Error(err, "Periodic refresh failed")
+			}
+		}
+	}
+}
+
+func (i *Index) SegmentForID(id int64) (*IndexSegment, bool) {
+	t := i.table.Load()
+	if t == nil {
+		return nil, false
+	}
+	n, ok := t.find(id)
+	if !ok {
+		return nil, false
+	}
+	return t.entries[n].segment, true
 }
 
 func (i *Index) LookupMeta(id int64, rec *IndexRecord) error {
 	defer metrics.Measure(metrics.IndexLookupLatency)()
+	// Records written, but not yet published, are not visible.
 	seg, ok := i.SegmentForID(id)
-	if !ok {
+	if !ok || id > i.MaxRecord.Load() {
+		return errors.NotFound{RecordID: id}
+	}
+	if err := seg.Acquire(); err == errSegmentReleased {
+		return errors.NotFound{RecordID: id}
+	} else if err != nil {
+		return err
+	}
+	found := seg.LoadRecord(id, rec)
+	if err := seg.Release(); err != nil {
+		return err
+	}
+	if !found {
 		return errors.NotFound{RecordID: id}
 	}
-	seg.LoadRecord(id, rec)
 	return nil
 }
 
@@ -229,12 +840,8 @@ func (i *Index) ReadRecord(rec *IndexRecord) (io.Reader, error) {
 }
 
 func (i *Index) IsEmpty() bool {
-	if i.MinSegment.Load() == 0 && i.MaxSegment.Load() == 0 {
-		return i.CurrentSegment.RecordsCount.Load() == 0
-	}
-
 	for _, seg := range i.Segments.Range() {
-		if !seg.Purged {
+		if !seg.Purged && seg.RecordsCount.Load() > 0 {
 			return false
 		}
 	}
@@ -244,19 +851,15 @@ func (i *Index) IsEmpty() bool {
 
 func (i *Index) CountObjects(id int64, inclusive bool) int64 {
 	defer metrics.Measure(metrics.IndexCountObjectsLatency)()
-	seg, ok := i.SegmentForID(id)
-	if !ok {
+	t := i.table.Load()
+	if t == nil {
 		return 0
 	}
-	total := seg.UpperRecord.Load() - id
-
-	for {
-		seg, ok = i.Segments.Load(seg.SegmentID + 1)
-		if !ok {
-			break
-		}
-		total += seg.RecordsCount.Load()
+	n, ok := t.find(id)
+	if !ok {
+		return 0
 	}
+	total := t.entries[n].segment.UpperRecord.Load() - id + t.countFrom(n)
 	if inclusive {
 		total += 1
 	}
@@ -267,8 +870,13 @@ func (i *Index) ReadObjects(id int64, inclusive bool) IndexCursor {
 	if !inclusive {
 		id += 1
 	}
-	if id == -1 {
-		id = 0
+	if first := i.Config.GetFirstRecordID(); id < first {
+		id = first
+	}
+	// Records vacuumed before the cursor is created are skipped, as only
+	// those vacuumed afterward yield a VacuumedError.
+	if minID := i.MinimumRecordID(); id < minID {
+		id = minID
 	}
 	return &indexCursor{
 		index: i,
@@ -276,11 +884,184 @@ func (i *Index) ReadObjects(id int64, inclusive bool) IndexCursor {
 	}
 }
 
+// ReadObjectsSnapshot behaves like ReadObjects, but returns a cursor bounded
+// to the records available when it was created. Those records remain
+// readable until the cursor is closed, even if vacuumed in the meantime.
+func (i *Index) ReadObjectsSnapshot(id int64, inclusive bool) IndexCursor {
+	cur := i.ReadObjects(id, inclusive).(*indexCursor)
+	cur.snapshot = i.takeSnapshot()
+	return cur
+}
+
+// TruncateAfter removes all records with ids greater than id, so that the
+// next appended record receives id+1. Index segments are truncated from the
+// newest to the oldest, so that a crash halfway through always leaves a
+// contiguous sequence of records behind; data written after the last
+// remaining record is discarded by the data manager, or by recovery during
+// the next startup.
+func (i *Index) TruncateAfter(id int64) error {
+	if i.readOnly {
+		return errors.ErrReadOnly
+	}
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	defer metrics.Measure(metrics.IndexTruncateAfterLatency)()
+	defer i.publishSegments()
+
+	if err := i.waitStreamLocked(); err != nil {
+		return err
+	}
+	if err := i.checkEpoch(); err != nil {
+		return err
+	}
+	if id >= i.MaxRecord.Load() {
+		return nil
+	}
+
+	// Truncated segments are reused by further appends, so records held by
+	// snapshots cannot be truncated. Snapshots are kept from being taken
+	// until truncation finishes.
+	i.snapshotsMu.Lock()
+	defer i.snapshotsMu.Unlock()
+	for s := range i.snapshots {
+		if s.lower <= s.upper && id < s.upper {
+			return errors.SnapshotInUseError{RecordID: id, Upper: s.upper}
+		}
+	}
+
+	first := &IndexRecord{}
+	if err := i.LookupMeta(id+1, first); err != nil {
+		return err
+	}
+	boundary, _ := i.SegmentForID(id + 1)
+
+	i.log.Info("Truncation starting", "id", id)
+	defer i.log.Info("Truncation finished")
+
+	for segID := i.MaxSegment.Load(); segID > boundary.SegmentID; segID-- {
+		seg, ok := i.Segments.Load(segID)
+		if !ok {
+			continue
+		}
+		if err := i.unlinkSegment(seg); err != nil {
+			return err
+		}
+	}
+
+	prev, hasPrev := i.Segments.Load(boundary.SegmentID - 1)
+	if boundary.FirstRecordID > id && hasPrev {
+		if err := i.unlinkSegment(boundary); err != nil {
+			return err
+		}
+		if err := prev.unseal(); err != nil {
+			return err
+		}
+		i.CurrentSegment = prev
+	} else {
+		i.log.Debug("Truncating segment", "segment_id", boundary.SegmentID)
+		if err := boundary.unseal(); err != nil {
+			return err
+		}
+		boundary.TruncateAfter(id)
+		if err := boundary.Sync(); err != nil {
+			return err
+		}
+		i.CurrentSegment = boundary
+	}
+
+	i.MaxSegment.Store(i.CurrentSegment.SegmentID)
+	i.MaxRecord.Store(id)
+	i.written = id
+	i.stampCurrentSegment()
+
+	if err := i.store.Sync(); err != nil {
+		return err
+	}
+	return i.dm.Rewind(first)
+}
+
+// dropSegment stops tracking a segment without removing it from disk.
+// Callers must hold writeMu, or have exclusive access to the index.
+func (i *Index) dropSegment(seg *IndexSegment) error {
+	if err := seg.Close(); err != nil {
+		i.log.Error(err, "Failed closing segment", "segment_id", seg.SegmentID)
+		return err
+	}
+	i.Segments.Delete(seg.SegmentID)
+	i.LoadedSegments.Add(-1)
+	return nil
+}
+
+func (i *Index) unlinkSegment(seg *IndexSegment) error {
+	i.log.Debug("Unlinking segment", "segment_id", seg.SegmentID)
+	if err := seg.Unlink(); err != nil {
+		i.log.Error(err, "Failed unlinking segment", "segment_id", seg.SegmentID)
+		return err
+	}
+	i.Segments.Delete(seg.SegmentID)
+	i.LoadedSegments.Add(-1)
+	return nil
+}
+
+// vacuumDataLocked removes data segments that are neither referenced by
+// records in the index, nor pinned by snapshots, nor being written by an
+// ObjectWriter. Callers must hold both writeMu and snapshotsMu.
+func (i *Index) vacuumDataLocked() error {
+	drsInUse := map[int64]bool{}
+	for _, seg := range i.Segments.Range() {
+		if seg.Purged {
+			continue
+		}
+		if err := seg.Acquire(); err != nil {
+			return err
+		}
+		minID, maxID := seg.LowerRecord.Load(), seg.UpperRecord.Load()
+		rec := &IndexRecord{}
+		for i := minID; i <= maxID; i++ {
+			seg.LoadRecord(i, rec)
+			if rec.Purged {
+				continue
+			}
+			for i := rec.DataSegmentStartID; i <= rec.DataSegmentEndID; i++ {
+				drsInUse[i] = true
+			}
+		}
+		if err := seg.Release(); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range i.pinnedDataSegmentsLocked() {
+		drsInUse[k] = true
+	}
+
+	dataInUse := make([]int64, 0, len(drsInUse))
+	for k := range drsInUse {
+		dataInUse = append(dataInUse, k)
+	}
+
+	keepFrom := int64(math.MaxInt64)
+	if i.stream != nil {
+		keepFrom = i.stream.rec.DataSegmentStartID
+	}
+	return i.dm.VacuumDataSegments(dataInUse, keepFrom)
+}
+
 func (i *Index) VacuumObjects(id int64, inclusive bool) error {
+	if i.readOnly {
+		return errors.ErrReadOnly
+	}
 	i.writeMu.Lock()
 	defer i.writeMu.Unlock()
 	defer metrics.Measure(metrics.IndexVacuumObjectsLatency)()
+	defer i.publishSegments()
 
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	if err := i.checkEpoch(); err != nil {
+		return err
+	}
 	if !inclusive {
 		id = id - 1
 	}
@@ -292,6 +1073,9 @@ func (i *Index) VacuumObjects(id int64, inclusive bool) error {
 	i.log.Info("Vacuum starting", "id", id)
 	defer i.log.Info("Vacuum finished")
 
+	i.snapshotsMu.Lock()
+	defer i.snapshotsMu.Unlock()
+
 	seg, ok := i.SegmentForID(id)
 	if !ok {
 		i.log.Warning("Attempt to vacuum from non-existing object", "id", id)
@@ -301,7 +1085,13 @@ func (i *Index) VacuumObjects(id int64, inclusive bool) error {
 	var segsToRemove []int64
 
 	i.log.Debug("Vacuum starting at segment", "id", seg.SegmentID)
+	if err := seg.Acquire(); err != nil {
+		return err
+	}
 	seg.PurgeFrom(id)
+	if err := seg.Release(); err != nil {
+		return err
+	}
 	if seg.Purged {
 		segsToRemove = append(segsToRemove, seg.SegmentID)
 		i.log.Debug("Vacuum purged segment as start offset was its last possible item", "id", seg.SegmentID)
@@ -314,38 +1104,35 @@ func (i *Index) VacuumObjects(id int64, inclusive bool) error {
 		if !ok {
 			break
 		}
+		if err := seg.Acquire(); err != nil {
+			return err
+		}
 		seg.Purged = true
 		seg.FlushMetadata()
+		if err := seg.Release(); err != nil {
+			return err
+		}
 		i.log.Debug("Marking segment as purged", "id", segID)
 		segsToRemove = append(segsToRemove, segID)
 		segID--
 	}
 
-	drsInUse := map[int64]bool{}
-	for _, seg := range i.Segments.Range() {
-		if seg.Purged {
-			continue
-		}
-		minID, maxID := seg.LowerRecord.Load(), seg.UpperRecord.Load()
-		rec := &IndexRecord{}
-		for i := minID; i <= maxID; i++ {
-			seg.LoadRecord(i, rec)
-			if rec.Purged {
-				continue
-			}
-			for i := rec.DataSegmentStartID; i <= rec.DataSegmentEndID; i++ {
-				drsInUse[i] = true
-			}
-		}
+	for s := range i.snapshots {
+		s.vacuumed = true
 	}
 
-	dataInUse := make([]int64, 0, len(drsInUse))
-	for k := range drsInUse {
-		dataInUse = append(dataInUse, k)
+	if err := i.vacuumDataLocked(); err != nil {
+		return err
 	}
 
-	if err := i.dm.VacuumDataSegments(dataInUse); err != nil {
-		return err
+	if len(segsToRemove) == int(i.LoadedSegments.Load()) {
+		// Every segment is about to be removed. Rotate beforehand so the new
+		// segment carries the next record id, keeping ids monotonic.
+		i.log.Debug("All segments will be cleared during vacuum. Creating a new segment...")
+		if err := i.Rotate(); err != nil {
+			i.log.Error(err, "Failed creating new segment")
+			return err
+		}
 	}
 
 	for _, v := range segsToRemove {
@@ -366,15 +1153,6 @@ func (i *Index) VacuumObjects(id int64, inclusive bool) error {
 		}
 	}
 
-	if i.LoadedSegments.Load() == 0 {
-		i.log.Debug("All segments were cleared during vacuum. Recreating initial segment...")
-		if err := i.Rotate(); err != nil {
-			i.log.Error(err, "Failed recreating initial segment", "segment_id", i.CurrentSegment.SegmentID)
-			return err
-		}
-		i.MaxSegment.Store(0)
-	}
-
 	minSeg := int64(math.MaxInt64)
 	maxSeg := int64(0)
 	for k, _ := range i.Segments.Range() {
@@ -390,19 +1168,18 @@ func (i *Index) VacuumObjects(id int64, inclusive bool) error {
 
 	if i.CurrentSegment == nil {
 		i.CurrentSegment, _ = i.Segments.Load(i.MaxSegment.Load())
-	}
-
-	if rec := i.CurrentSegment.UpperRecord.Load(); rec == 0 {
-		i.MaxRecord.Store(-1)
-	} else {
-		i.MaxRecord.Store(rec)
+		if i.CurrentSegment != nil {
+			if err := i.CurrentSegment.unseal(); err != nil {
+				return err
+			}
+			i.stampCurrentSegment()
+		}
 	}
 
 	return nil
 }
 
 func (i *Index) measureUsage() {
-	wd := i.Config.GetWorkdir()
 loop:
 	for range i.measureUsageTimer.C {
 		totalIndexSize := int64(0)
@@ -410,26 +1187,23 @@ loop:
 		indexFiles := 0
 		dataFiles := 0
 
-		entries, err := os.ReadDir(wd)
+		names, err := i.store.List()
 		if err != nil {
-			i.log.Error(err, "Failed reading directory for usage measurement", "path", wd)
+			i.log.Error(err, "Failed listing files for usage measurement")
 			continue loop
 		}
-		for _, v := range entries {
-			if v.IsDir() {
-				continue
-			}
-			stat, err := os.Stat(filepath.Join(wd, v.Name()))
+		for _, name := range names {
+			size, err := i.store.Size(name)
 			if err != nil {
-				i.log.Error(err, "Failed calling stat for directory entry", "name", v.Name())
+				i.log.Error(err, "Failed obtaining file size", "name", name)
 				continue loop
 			}
 			switch {
-			case strings.HasPrefix(v.Name(), "data"):
-				totalDataSize += stat.Size()
+			case isSegmentFile(name, dataSegmentPrefix):
+				totalDataSize += size
 				dataFiles++
-			case strings.HasPrefix(v.Name(), "index"):
-				totalIndexSize += stat.Size()
+			case isSegmentFile(name, indexSegmentPrefix):
+				totalIndexSize += size
 				indexFiles++
 			}
 		}
@@ -1,33 +1,246 @@
 package internal
 
-import "io"
+import (
+	"context"
+	errs "errors"
+	"io"
+
+	"github.com/heyvito/wal/errors"
+)
 
 type IndexCursor interface {
 	Next() bool
+	NextWait(ctx context.Context) bool
+	Prev() bool
+	SeekTo(id int64)
+	SeekToFirst()
+	SeekToLast()
+	Close() error
 	Read() (io.Reader, error)
 	Offset() int64
+	Err() error
 }
 
+// indexCursor walks records of an index in both directions. Records are
+// looked up starting from wants when moving forward. Once a record has been
+// loaded, current holds its id, and positioned is set; when the cursor is
+// exhausted in either direction, it sits between records, and the next
+// record in the opposite direction is the one closest to wants.
 type indexCursor struct {
-	index  *Index
-	wants  int64
-	record IndexRecord
+	index      *Index
+	wants      int64
+	current    int64
+	positioned bool
+	record     IndexRecord
+	err        error
+
+	// snapshot, when set, bounds the cursor to the records available when it
+	// was created, and keeps them from being removed by vacuum.
+	snapshot *snapshot
+
+	// waitErr holds the reason the last call to NextWait gave up waiting.
+	// Contrary to err, it is cleared by further calls to Next or NextWait.
+	waitErr error
 }
 
+func (i *indexCursor) minID() int64 {
+	if i.snapshot != nil {
+		return i.snapshot.lower
+	}
+	return i.index.MinimumRecordID()
+}
+
+func (i *indexCursor) maxID() int64 {
+	if i.snapshot != nil {
+		return i.snapshot.upper
+	}
+	return i.index.MaxRecord.Load()
+}
+
+func (i *indexCursor) lookup(id int64, rec *IndexRecord) error {
+	if i.snapshot != nil {
+		return i.snapshot.lookup(id, rec)
+	}
+	return i.index.LookupMeta(id, rec)
+}
+
+// Next advances the cursor to the next record that has not been purged.
+// Returns false once the end of the index is reached, or in case an error
+// occurs, in which case Err returns it. Reaching the end of the index is not
+// an error, and Next may return true again once new records are appended.
 func (i *indexCursor) Next() bool {
-	err := i.index.LookupMeta(i.wants, &i.record)
-	if err != nil {
+	i.waitErr = nil
+	if i.err != nil {
 		return false
 	}
-	i.wants++
-	return true
+
+	for {
+		if i.index.closed.Load() {
+			i.err = errors.ErrClosed
+			return false
+		}
+		if i.wants > i.maxID() {
+			i.positioned = false
+			return false
+		}
+
+		err := i.lookup(i.wants, &i.record)
+		if errs.As(err, &errors.NotFound{}) {
+			// The record was assigned, but is not present in the index
+			// anymore; it has been vacuumed from under the cursor.
+			i.err = errors.VacuumedError{RecordID: i.wants}
+			return false
+		} else if err != nil {
+			i.err = err
+			return false
+		}
+
+		i.wants++
+		if !i.record.Purged {
+			i.current = i.wants - 1
+			i.positioned = true
+			return true
+		}
+	}
+}
+
+// Prev moves the cursor to the previous record that has not been purged.
+// Returns false once the first available record has been passed, or in case
+// an error occurs, in which case Err returns it.
+func (i *indexCursor) Prev() bool {
+	i.waitErr = nil
+	if i.err != nil {
+		return false
+	}
+
+	id := i.wants - 1
+	if i.positioned {
+		id = i.current - 1
+	}
+	if maxID := i.maxID(); id > maxID {
+		id = maxID
+	}
+
+	for ; ; id-- {
+		if i.index.closed.Load() {
+			i.err = errors.ErrClosed
+			return false
+		}
+		if id < i.minID() {
+			break
+		}
+
+		err := i.lookup(id, &i.record)
+		if errs.As(err, &errors.NotFound{}) {
+			// Records before id have been vacuumed; the beginning of the
+			// index has been reached.
+			break
+		} else if err != nil {
+			i.err = err
+			return false
+		}
+
+		if !i.record.Purged {
+			i.current = id
+			i.wants = id + 1
+			i.positioned = true
+			return true
+		}
+	}
+
+	i.wants = id + 1
+	i.positioned = false
+	return false
+}
+
+// SeekTo positions the cursor so that Next yields the first available record
+// with an id equal to or greater than id, and Prev yields the last one with
+// a smaller id. Ids are clamped to the range of available records. Seeking
+// clears errors reported by Err, except for ErrClosed.
+func (i *indexCursor) SeekTo(id int64) {
+	if minID := i.minID(); id < minID {
+		id = minID
+	}
+	if maxID := i.maxID(); id > maxID+1 {
+		id = maxID + 1
+	}
+	i.wants = id
+	i.positioned = false
+	i.waitErr = nil
+	if i.err != nil && !errs.Is(i.err, errors.ErrClosed) {
+		i.err = nil
+	}
+}
+
+// SeekToFirst positions the cursor so that Next yields the first available
+// record.
+func (i *indexCursor) SeekToFirst() {
+	i.SeekTo(i.minID())
+}
+
+// SeekToLast positions the cursor after the last record, so that Prev
+// yields it.
+func (i *indexCursor) SeekToLast() {
+	i.SeekTo(i.maxID() + 1)
+}
+
+// NextWait behaves like Next, but blocks until a new record is appended in
+// case the end of the index has been reached. Returns false in case ctx is
+// done, the index is closed, or an error occurs. Snapshot cursors never wait,
+// as no records are appended to their snapshot.
+func (i *indexCursor) NextWait(ctx context.Context) bool {
+	for {
+		// Obtain the channel before checking for records, so appends
+		// happening between both operations are not missed.
+		appended := i.index.appended.wait()
+		if i.Next() {
+			return true
+		}
+		if i.err != nil || i.snapshot != nil {
+			return false
+		}
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			i.waitErr = ctx.Err()
+			return false
+		}
+	}
 }
 
 func (i *indexCursor) Read() (io.Reader, error) {
-	return i.index.ReadRecord(&i.record)
+	r, err := i.index.ReadRecord(&i.record)
+	if errs.As(err, &errors.CorruptedRecordError{}) {
+		i.err = err
+	}
+	return r, err
 }
 
 func (i *indexCursor) Offset() int64 {
-	// Assumes Next() has been called (as it should)
-	return i.wants - 1
+	// Assumes Next() or Prev() has been called (as it should)
+	return i.current
+}
+
+// Close releases the snapshot held by the cursor, if any. Further calls to
+// Next or Prev return false.
+func (i *indexCursor) Close() error {
+	if i.err == nil {
+		i.err = errors.ErrClosed
+	}
+	if i.snapshot == nil {
+		return nil
+	}
+	s := i.snapshot
+	i.snapshot = nil
+	return i.index.releaseSnapshot(s)
+}
+
+// Err returns the error that caused Next or NextWait to return false, if
+// any.
+func (i *indexCursor) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.waitErr
 }
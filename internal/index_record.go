@@ -1,6 +1,22 @@
 package internal
 
-const IndexRecordSize = 8*5 + 1
+import "hash/crc32"
+
+// IndexRecordSize represents the amount of bytes taken by a single index
+// record, including its CRC32C checksum.
+const IndexRecordSize = 8*5 + 1 + 4
+
+// LegacyIndexRecordSize represents the amount of bytes taken by records
+// written before checksums were introduced. Those records are still readable,
+// but segments containing them are never appended to.
+const LegacyIndexRecordSize = 8*5 + 1
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32C checksum of the provided data.
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
 
 type IndexRecord struct {
 	RecordID           int64
@@ -9,9 +25,23 @@ type IndexRecord struct {
 	DataSegmentEndID   int64
 	Size               int64
 	Purged             bool
+	Checksum           uint32
+
+	// Checksummed indicates whether Checksum holds a value that can be used
+	// to validate the record's data. Records loaded from legacy segments
+	// do not carry a checksum.
+	Checksummed bool
 }
 
 func (i *IndexRecord) Read(b []byte) {
+	i.ReadLegacy(b)
+	i.Checksum = be.Uint32(b[indexRecordOffsets.Checksum:])
+	i.Checksummed = true
+}
+
+// ReadLegacy reads a record stored in the format used before checksums were
+// introduced.
+func (i *IndexRecord) ReadLegacy(b []byte) {
 	i.RecordID = int64(be.Uint64(b[indexRecordOffsets.RecordID:]))
 	i.DataSegmentStartID = int64(be.Uint64(b[indexRecordOffsets.DataSegmentStartID:]))
 	i.DataSegmentEndID = int64(be.Uint64(b[indexRecordOffsets.DataSegmentEndID:]))
@@ -19,6 +49,8 @@ func (i *IndexRecord) Read(b []byte) {
 	i.Size = int64(be.Uint64(b[indexRecordOffsets.Size:]))
 	flags := b[indexRecordOffsets.Flags]
 	i.Purged = flags&0x01 != 0x00
+	i.Checksum = 0
+	i.Checksummed = false
 }
 
 func (i *IndexRecord) Write(b []byte) {
@@ -32,6 +64,7 @@ func (i *IndexRecord) Write(b []byte) {
 		flags |= 0x01
 	}
 	b[indexRecordOffsets.Flags] = flags
+	be.PutUint32(b[indexRecordOffsets.Checksum:], i.Checksum)
 }
 
 func SetIndexRecordPurged(b []byte) {
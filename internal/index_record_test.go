@@ -14,15 +14,16 @@ func TestIndexRecordWrite(t *testing.T) {
 		DataSegmentOffset:  40,
 		Size:               50,
 		Purged:             false,
+		Checksum:           0xCAFEBABE,
 	}
 	data := make([]byte, IndexRecordSize)
 	rec.Write(data)
-	expected := mustByesFromHex("00000000 0000000A 00000000 00000014 00000000 0000001E 00000000 00000028 00000000 00000032 00")
+	expected := mustByesFromHex("00000000 0000000A 00000000 00000014 00000000 0000001E 00000000 00000028 00000000 00000032 00 CAFEBABE")
 	assert.Equal(t, expected, data)
 }
 
 func TestIndexRecordRead(t *testing.T) {
-	data := mustByesFromHex("00000000 0000000A 00000000 00000014 00000000 0000001E 00000000 00000028 00000000 00000032 00")
+	data := mustByesFromHex("00000000 0000000A 00000000 00000014 00000000 0000001E 00000000 00000028 00000000 00000032 00 CAFEBABE")
 	expected := IndexRecord{
 		RecordID:           10,
 		DataSegmentStartID: 20,
@@ -30,8 +31,25 @@ func TestIndexRecordRead(t *testing.T) {
 		DataSegmentOffset:  40,
 		Size:               50,
 		Purged:             false,
+		Checksum:           0xCAFEBABE,
+		Checksummed:        true,
 	}
 	current := IndexRecord{}
 	current.Read(data)
 	assert.Equal(t, expected, current)
 }
+
+func TestIndexRecordReadLegacy(t *testing.T) {
+	data := mustByesFromHex("00000000 0000000A 00000000 00000014 00000000 0000001E 00000000 00000028 00000000 00000032 01")
+	expected := IndexRecord{
+		RecordID:           10,
+		DataSegmentStartID: 20,
+		DataSegmentEndID:   30,
+		DataSegmentOffset:  40,
+		Size:               50,
+		Purged:             true,
+	}
+	current := IndexRecord{}
+	current.ReadLegacy(data)
+	assert.Equal(t, expected, current)
+}
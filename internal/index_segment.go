@@ -1,21 +1,34 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"github.com/heyvito/wal/internal/metrics"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
-
-	"github.com/heyvito/gommap"
 )
 
 const IndexSegmentMetadataSize = 6*8 + 1
 
+// IndexSegmentEpochMetadataSize holds the size of the header of segments
+// carrying the epoch of the writer appending to them, which follows the
+// fields shared with older segments.
+const IndexSegmentEpochMetadataSize = IndexSegmentMetadataSize + 8
+
+// indexSegmentMetadataSize returns the size of the header of a segment
+// holding the given flags.
+func indexSegmentMetadataSize(flags byte) int64 {
+	if flags&indexSegmentFlagEpoch != 0 {
+		return IndexSegmentEpochMetadataSize
+	}
+	return IndexSegmentMetadataSize
+}
+
 type IndexSegment struct {
 	Path          string
-	File          *os.File
+	File          SegmentFile
 	SegmentID     int64
 	Size          int64
 	FirstRecordID int64
@@ -26,57 +39,105 @@ type IndexSegment struct {
 	Cursor       atomic.Int64
 	Purged       bool
 
-	RawData  gommap.MMap
-	Metadata gommap.MMap
-	Records  gommap.MMap
+	// Checksummed indicates whether records in this segment carry a CRC32C
+	// checksum. Segments created before checksums were introduced are kept
+	// for reading only, and are never appended to.
+	Checksummed bool
+	RecordSize  int64
+
+	// MetadataSize holds the size of the segment's header, which precedes
+	// its records. Segments created before epochs were introduced have no
+	// room for one, and always report an Epoch of zero.
+	MetadataSize int64
+
+	// Epoch holds the epoch of the last writer that appended to the segment.
+	Epoch int64
+
+	RawData  []byte
+	Metadata []byte
+	Records  []byte
+
+	writeMu       sync.Mutex
+	dirty         dirtyRange
+	metadataDirty bool
+	refs          segmentRefs
+
+	// mapMu guards RawData, Metadata, Records and File, which are only set
+	// while the segment is mapped. sealed indicates whether the segment is
+	// no longer appended to, and may be unmapped by cache.
+	mapMu  sync.Mutex
+	sealed atomic.Bool
+	cache  *segmentCache
+
+	name  string
+	store SegmentStore
 
-	writeMu sync.Mutex
+	// readOnly indicates whether the segment belongs to a read-only index,
+	// in which case it is mapped read-only and never written to. Segments
+	// fenced out by another writer are never flushed either. Guarded by
+	// mapMu.
+	readOnly bool
 }
 
-func NewIndexSegment(id int64, config Config) (*IndexSegment, error) {
-	path := filepath.Join(config.GetWorkdir(), fmt.Sprintf("index%04d", id))
-	var fd *os.File
-	stat, err := os.Stat(path)
+// NewIndexSegment opens the index segment identified by id, creating it when
+// it does not exist. New segments start assigning record ids from base.
+func NewIndexSegment(id, base int64, config Config) (*IndexSegment, error) {
+	return openIndexSegment(id, base, 0, config, nil, false)
+}
+
+// openIndexSegment opens the index segment identified by id, creating it
+// when it does not exist. When lazy is set, an existing segment only has its
+// metadata read, being mapped once acquired. Mappings are tracked by the
+// provided cache. New segments are stamped with epoch. Read-only
+// configurations never create segments.
+func openIndexSegment(id, base, epoch int64, config Config, cache *segmentCache, lazy bool) (*IndexSegment, error) {
+	name := indexSegmentName(id)
+	store := config.GetStore()
+	readOnly := config.GetReadOnly()
 	isNew := false
-	switch {
-	case os.IsNotExist(err):
-		fd, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_EXCL|os.O_SYNC, 0644)
-		isNew = true
-	case err != nil:
-		return nil, err
-	case stat.IsDir():
-		return nil, fmt.Errorf("%s: is a directory", path)
-	default:
-		fd, err = os.OpenFile(path, os.O_RDWR|os.O_EXCL|os.O_SYNC, 0644)
+	if !readOnly {
+		err := store.Create(name, config.GetIndexSegmentSize()+IndexSegmentEpochMetadataSize)
+		isNew = err == nil
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
 	}
-	if err != nil {
-		return nil, err
+
+	seg := &IndexSegment{
+		Path:        filepath.Join(config.GetWorkdir(), name),
+		SegmentID:   id,
+		Size:        config.GetIndexSegmentSize(),
+		Checksummed: true,
+		RecordSize:  IndexRecordSize,
+		cache:       cache,
+		name:        name,
+		store:       store,
+		readOnly:    readOnly,
 	}
+	seg.refs.init()
 
-	if isNew {
-		if err = fd.Truncate(config.GetIndexSegmentSize() + IndexSegmentMetadataSize); err != nil {
-			_ = fd.Close()
+	if lazy && !isNew {
+		meta, first, err := seg.readHead()
+		if err != nil {
 			return nil, err
 		}
+		seg.loadMetadata(meta, first)
+		seg.sealed.Store(true)
+		return seg, nil
 	}
 
-	mapped, err := gommap.Map(fd.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
-	if err != nil {
-		_ = fd.Close()
-		return nil, err
+	if isNew {
+		seg.MetadataSize = IndexSegmentEpochMetadataSize
+		seg.Epoch = epoch
 	}
 
-	seg := &IndexSegment{
-		Path:      path,
-		File:      fd,
-		SegmentID: id,
-		Size:      config.GetIndexSegmentSize(),
-		RawData:   mapped,
-		Metadata:  mapped[:IndexSegmentMetadataSize],
-		Records:   mapped[IndexSegmentMetadataSize:],
+	if err := seg.mapLocked(); err != nil {
+		return nil, err
 	}
-
 	if isNew {
+		seg.FirstRecordID = base
+		seg.LowerRecord.Store(base)
+		seg.UpperRecord.Store(base - 1)
 		seg.FlushMetadata()
 	} else {
 		seg.LoadMetadata()
@@ -85,19 +146,147 @@ func NewIndexSegment(id int64, config Config) (*IndexSegment, error) {
 	return seg, nil
 }
 
+// indexSegmentFromManifest returns an unmapped segment whose metadata is
+// described by a manifest entry.
+func indexSegmentFromManifest(entry []byte, config Config, cache *segmentCache) *IndexSegment {
+	seg := &IndexSegment{cache: cache, store: config.GetStore(), readOnly: config.GetReadOnly()}
+	seg.decodeMetadata(entry[:len(entry)-8])
+	seg.FirstRecordID = int64(be.Uint64(entry[len(entry)-8:]))
+	seg.name = indexSegmentName(seg.SegmentID)
+	seg.Path = filepath.Join(config.GetWorkdir(), seg.name)
+	seg.refs.init()
+	seg.sealed.Store(true)
+	return seg
+}
+
+func indexSegmentName(id int64) string {
+	return fmt.Sprintf("%s%04d", indexSegmentPrefix, id)
+}
+
 func (s *IndexSegment) LoadMetadata() {
-	s.SegmentID = int64(be.Uint64(s.Metadata[indexSegmentOffsets.SegmentID:]))
-	s.Size = int64(be.Uint64(s.Metadata[indexSegmentOffsets.Size:]))
-	s.LowerRecord.Store(int64(be.Uint64(s.Metadata[indexSegmentOffsets.LowerRecord:])))
-	s.UpperRecord.Store(int64(be.Uint64(s.Metadata[indexSegmentOffsets.UpperRecord:])))
-	s.RecordsCount.Store(int64(be.Uint64(s.Metadata[indexSegmentOffsets.RecordsCount:])))
-	s.Cursor.Store(int64(be.Uint64(s.Metadata[indexSegmentOffsets.Cursor:])))
-	flags := s.Metadata[indexSegmentOffsets.Flags]
-	s.Purged = flags&(0x01<<0) != 0
+	s.loadMetadata(s.Metadata, s.Records)
+}
+
+// loadMetadata loads the segment's metadata from meta, and its first record
+// id from records.
+func (s *IndexSegment) loadMetadata(meta, records []byte) {
+	s.decodeMetadata(meta)
 	if s.Cursor.Load() > 0 {
 		rec := &IndexRecord{}
-		rec.Read(s.Records)
+		s.readRecord(records, rec)
 		s.FirstRecordID = rec.RecordID
+	} else {
+		s.FirstRecordID = s.LowerRecord.Load()
+	}
+}
+
+// readHead reads the segment's header from its file, followed by its first
+// record, which is nil in case the segment holds no records.
+func (s *IndexSegment) readHead() (meta, first []byte, err error) {
+	meta = make([]byte, IndexSegmentEpochMetadataSize)
+	if err = s.store.ReadAt(s.name, meta, 0); err != nil {
+		return nil, nil, err
+	}
+	flags := meta[indexSegmentOffsets.Flags]
+	meta = meta[:indexSegmentMetadataSize(flags)]
+	if be.Uint64(meta[indexSegmentOffsets.Cursor:]) == 0 {
+		return meta, nil, nil
+	}
+	first = make([]byte, IndexRecordSize)
+	if flags&indexSegmentFlagChecksummed == 0 {
+		first = first[:LegacyIndexRecordSize]
+	}
+	if err = s.store.ReadAt(s.name, first, int64(len(meta))); err != nil {
+		return nil, nil, err
+	}
+	return meta, first, nil
+}
+
+// refresh re-reads the segment's metadata from its file, picking up changes
+// made by the process writing to it. Fields that are not updated atomically
+// are only assigned when changed, so readers of a segment whose structure
+// is unaffected never observe concurrent writes to them.
+func (s *IndexSegment) refresh() error {
+	meta, first, err := s.readHead()
+	if err != nil {
+		return err
+	}
+	s.LowerRecord.Store(int64(be.Uint64(meta[indexSegmentOffsets.LowerRecord:])))
+	s.UpperRecord.Store(int64(be.Uint64(meta[indexSegmentOffsets.UpperRecord:])))
+	s.RecordsCount.Store(int64(be.Uint64(meta[indexSegmentOffsets.RecordsCount:])))
+	if purged := meta[indexSegmentOffsets.Flags]&indexSegmentFlagPurged != 0; purged != s.Purged {
+		s.Purged = purged
+	}
+	if size := int64(len(meta)); size != s.MetadataSize {
+		// The segment was first read before its creator wrote its header.
+		s.mapMu.Lock()
+		if s.RawData == nil {
+			s.MetadataSize = size
+		}
+		s.mapMu.Unlock()
+	}
+	if epoch := decodeIndexSegmentEpoch(meta); epoch != s.Epoch {
+		s.Epoch = epoch
+	}
+
+	cursor := int64(be.Uint64(meta[indexSegmentOffsets.Cursor:]))
+	firstID := s.LowerRecord.Load()
+	if first != nil {
+		rec := &IndexRecord{}
+		s.readRecord(first, rec)
+		firstID = rec.RecordID
+	}
+	if firstID != s.FirstRecordID {
+		s.FirstRecordID = firstID
+	}
+	s.Cursor.Store(cursor)
+	return nil
+}
+
+// decodeMetadata loads every metadata field but FirstRecordID from meta.
+func (s *IndexSegment) decodeMetadata(meta []byte) {
+	s.SegmentID = int64(be.Uint64(meta[indexSegmentOffsets.SegmentID:]))
+	s.Size = int64(be.Uint64(meta[indexSegmentOffsets.Size:]))
+	s.LowerRecord.Store(int64(be.Uint64(meta[indexSegmentOffsets.LowerRecord:])))
+	s.UpperRecord.Store(int64(be.Uint64(meta[indexSegmentOffsets.UpperRecord:])))
+	s.RecordsCount.Store(int64(be.Uint64(meta[indexSegmentOffsets.RecordsCount:])))
+	s.Cursor.Store(int64(be.Uint64(meta[indexSegmentOffsets.Cursor:])))
+	flags := meta[indexSegmentOffsets.Flags]
+	s.Purged = flags&indexSegmentFlagPurged != 0
+	s.Checksummed = flags&indexSegmentFlagChecksummed != 0
+	if s.Checksummed {
+		s.RecordSize = IndexRecordSize
+	} else {
+		s.RecordSize = LegacyIndexRecordSize
+	}
+	s.MetadataSize = indexSegmentMetadataSize(flags)
+	s.Epoch = decodeIndexSegmentEpoch(meta)
+}
+
+// decodeIndexSegmentEpoch returns the epoch held by a segment's header, or
+// zero in case it has no room for one.
+func decodeIndexSegmentEpoch(meta []byte) int64 {
+	if meta[indexSegmentOffsets.Flags]&indexSegmentFlagEpoch == 0 {
+		return 0
+	}
+	return int64(be.Uint64(meta[indexSegmentOffsets.Epoch:]))
+}
+
+// LastRecordID returns the id of the last record assigned by this segment.
+// Empty segments keep their base id as their lower bound, so the id
+// sequence survives even when every previous segment has been removed.
+func (s *IndexSegment) LastRecordID() int64 {
+	if s.Cursor.Load() > 0 {
+		return s.UpperRecord.Load()
+	}
+	return s.LowerRecord.Load() - 1
+}
+
+func (s *IndexSegment) readRecord(b []byte, rec *IndexRecord) {
+	if s.Checksummed {
+		rec.Read(b)
+	} else {
+		rec.ReadLegacy(b)
 	}
 }
 
@@ -105,17 +294,44 @@ func (s *IndexSegment) FlushMetadata() {
 	metrics.Simple(metrics.IndexSegmentFlushMetaCalls, 0)
 	defer metrics.Measure(metrics.IndexSegmentFlushMetaLatency)()
 
-	be.PutUint64(s.Metadata[indexSegmentOffsets.SegmentID:], uint64(s.SegmentID))
-	be.PutUint64(s.Metadata[indexSegmentOffsets.Size:], uint64(s.Size))
-	be.PutUint64(s.Metadata[indexSegmentOffsets.LowerRecord:], uint64(s.LowerRecord.Load()))
-	be.PutUint64(s.Metadata[indexSegmentOffsets.UpperRecord:], uint64(s.UpperRecord.Load()))
-	be.PutUint64(s.Metadata[indexSegmentOffsets.RecordsCount:], uint64(s.RecordsCount.Load()))
-	be.PutUint64(s.Metadata[indexSegmentOffsets.Cursor:], uint64(s.Cursor.Load()))
+	s.encodeMetadata(s.Metadata)
+	s.File.Flush(0, s.MetadataSize)
+	s.metadataDirty = true
+}
+
+// encodeMetadata writes the segment's metadata into b, using the layout of
+// the segment's header.
+func (s *IndexSegment) encodeMetadata(b []byte) {
+	be.PutUint64(b[indexSegmentOffsets.SegmentID:], uint64(s.SegmentID))
+	be.PutUint64(b[indexSegmentOffsets.Size:], uint64(s.Size))
+	be.PutUint64(b[indexSegmentOffsets.LowerRecord:], uint64(s.LowerRecord.Load()))
+	be.PutUint64(b[indexSegmentOffsets.UpperRecord:], uint64(s.UpperRecord.Load()))
+	be.PutUint64(b[indexSegmentOffsets.RecordsCount:], uint64(s.RecordsCount.Load()))
+	be.PutUint64(b[indexSegmentOffsets.Cursor:], uint64(s.Cursor.Load()))
 	flags := byte(0x00)
 	if s.Purged {
-		flags |= 0x01 << 0
+		flags |= indexSegmentFlagPurged
+	}
+	if s.Checksummed {
+		flags |= indexSegmentFlagChecksummed
 	}
-	s.Metadata[indexSegmentOffsets.Flags] = flags
+	if s.MetadataSize >= IndexSegmentEpochMetadataSize {
+		flags |= indexSegmentFlagEpoch
+		be.PutUint64(b[indexSegmentOffsets.Epoch:], uint64(s.Epoch))
+	}
+	b[indexSegmentOffsets.Flags] = flags
+}
+
+// stampEpoch records epoch as the epoch of the writer appending to the
+// segment. Segments without room for an epoch are left untouched.
+func (s *IndexSegment) stampEpoch(epoch int64) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.MetadataSize < IndexSegmentEpochMetadataSize || s.Epoch == epoch {
+		return
+	}
+	s.Epoch = epoch
+	s.FlushMetadata()
 }
 
 func (s *IndexSegment) ContainsRecord(id int64) bool {
@@ -133,42 +349,234 @@ func (s *IndexSegment) LoadRecord(id int64, rec *IndexRecord) bool {
 		return false
 	}
 
-	offset := (id - s.FirstRecordID) * IndexRecordSize
-	rec.Read(s.Records[offset:])
+	offset := (id - s.FirstRecordID) * s.RecordSize
+	s.readRecord(s.Records[offset:], rec)
 	return true
 }
 
+// FitsRecord returns whether a new record can be appended to this segment.
+// Legacy segments never accept new records.
 func (s *IndexSegment) FitsRecord() bool {
+	return s.FitsRecords(1)
+}
+
+// FitsRecords returns whether n new records can be appended to this segment.
+func (s *IndexSegment) FitsRecords(n int) bool {
 	s.writeMu.Lock()
 	defer s.writeMu.Unlock()
-	return s.Cursor.Load()+IndexRecordSize <= s.Size
+	return s.Checksummed && s.Cursor.Load()+int64(n)*s.RecordSize <= s.Size
 }
 
 func (s *IndexSegment) WriteRecord(rec *IndexRecord) {
+	s.WriteRecords([]*IndexRecord{rec})
+}
+
+// WriteRecords appends a sequence of contiguous records to the segment. All
+// records become visible at once, through a single metadata flush.
+func (s *IndexSegment) WriteRecords(recs []*IndexRecord) {
 	s.writeMu.Lock()
 	defer s.writeMu.Unlock()
 
 	defer metrics.Measure(metrics.IndexSegmentWriteRecordLatency)()
 
-	cur := s.Cursor.Load()
-	rec.Write(s.Records[cur:])
-	if cur == 0 {
-		s.LowerRecord.Store(rec.RecordID)
-		s.FirstRecordID = rec.RecordID
+	if len(recs) == 0 {
+		return
+	}
+
+	start := s.Cursor.Load()
+	cur := start
+	for _, rec := range recs {
+		rec.Write(s.Records[cur:])
+		cur += s.RecordSize
+	}
+	s.File.Flush(s.MetadataSize+start, cur-start)
+	s.dirty.mark(start, cur-start)
+	if start == 0 {
+		s.LowerRecord.Store(recs[0].RecordID)
+		s.FirstRecordID = recs[0].RecordID
 	}
-	s.Cursor.Add(IndexRecordSize)
-	s.UpperRecord.Store(rec.RecordID)
-	s.RecordsCount.Add(1)
+	s.Cursor.Store(cur)
+	s.UpperRecord.Store(recs[len(recs)-1].RecordID)
+	s.RecordsCount.Add(int64(len(recs)))
 	s.FlushMetadata()
 }
 
-func (s *IndexSegment) Close() error {
+// Sync flushes records written since the last call to Sync to stable storage,
+// followed by the segment's metadata. Flushing records first ensures the
+// metadata never exposes records that were not persisted.
+func (s *IndexSegment) Sync() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
 	s.writeMu.Lock()
-	defer s.writeMu.Unlock()
-	if err := s.RawData.Sync(gommap.MS_SYNC); err != nil {
+	offset, size := s.dirty.take()
+	metadataDirty := s.metadataDirty
+	s.metadataDirty = false
+	s.writeMu.Unlock()
+
+	if s.RawData == nil {
+		return nil
+	}
+	if err := s.File.Sync(s.MetadataSize+offset, size); err != nil {
+		return err
+	}
+	if metadataDirty {
+		return s.File.Sync(0, s.MetadataSize)
+	}
+	return nil
+}
+
+// Acquire obtains a reference to the segment, mapping it in case it is not
+// mapped, and preventing its memory from being unmapped until Release is
+// called. Returns errSegmentReleased in case the segment has already been
+// closed or unlinked and is no longer referenced.
+func (s *IndexSegment) Acquire() error {
+	if !s.refs.acquire() {
+		return errSegmentReleased
+	}
+	s.mapMu.Lock()
+	var err error
+	mapped := false
+	if s.RawData == nil {
+		err = s.mapLocked()
+		mapped = err == nil
+	}
+	s.mapMu.Unlock()
+	if err != nil {
+		_ = s.Release()
+		return err
+	}
+	if mapped {
+		s.cache.enforce()
+	}
+	return nil
+}
+
+// Release drops a reference obtained through Acquire.
+func (s *IndexSegment) Release() error {
+	if s.refs.release() {
+		return s.finalize()
+	}
+	s.cache.touch(s)
+	s.cache.enforce()
+	return nil
+}
+
+// Close flushes the segment to disk. Its memory is unmapped once all
+// references obtained through Acquire are released.
+func (s *IndexSegment) Close() error {
+	s.mapMu.Lock()
+	var err error
+	if s.RawData != nil && !s.readOnly {
+		s.writeMu.Lock()
+		err = s.File.Sync(0, int64(len(s.RawData)))
+		s.writeMu.Unlock()
+	}
+	s.mapMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.refs.releaseOwner() {
+		return s.finalize()
+	}
+	return nil
+}
+
+// fence prevents the segment from being flushed once closed or unmapped,
+// as another writer may have taken over the WAL and written to it.
+func (s *IndexSegment) fence() {
+	s.mapMu.Lock()
+	s.readOnly = true
+	s.mapMu.Unlock()
+}
+
+// finalize unmaps the segment and closes its file.
+func (s *IndexSegment) finalize() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+	if err := s.unmapLocked(false); err != nil {
+		return err
+	}
+	s.refs.finishUnlink()
+	return nil
+}
+
+// seal marks the segment as no longer being appended to, allowing it to be
+// unmapped once the mapping budget is exceeded.
+func (s *IndexSegment) seal() {
+	s.sealed.Store(true)
+	s.cache.enforce()
+}
+
+// unseal maps the segment and prevents it from being unmapped, so it can be
+// appended to.
+func (s *IndexSegment) unseal() error {
+	s.sealed.Store(false)
+	if err := s.Acquire(); err != nil {
+		return err
+	}
+	return s.Release()
+}
+
+func (s *IndexSegment) mappedSize() int64 { return s.Size + s.MetadataSize }
+
+func (s *IndexSegment) evict() bool {
+	if !s.sealed.Load() || !s.mapMu.TryLock() {
+		return false
+	}
+	defer s.mapMu.Unlock()
+	// Segments released by their owner are only referenced by readers, and
+	// are unmapped once the last of them is released.
+	if s.RawData == nil || !s.refs.owned.Load() || s.refs.count.Load() != 1 {
+		return false
+	}
+	return s.unmapLocked(true) == nil
+}
+
+// mapLocked opens the segment's file through its store. Callers must hold
+// mapMu.
+func (s *IndexSegment) mapLocked() error {
+	open := s.store.Open
+	if s.readOnly {
+		open = s.store.OpenReadOnly
+	}
+	file, err := open(s.name)
+	if err != nil {
+		return err
+	}
+	mapped := file.Bytes()
+	if s.MetadataSize == 0 {
+		s.MetadataSize = indexSegmentMetadataSize(mapped[indexSegmentOffsets.Flags])
+	}
+	s.File = file
+	s.RawData = mapped
+	s.Metadata = mapped[:s.MetadataSize]
+	s.Records = mapped[s.MetadataSize:]
+	s.cache.mapped(s)
+	return nil
+}
+
+// unmapLocked unmaps the segment and closes its file, flushing its contents
+// first when flush is set. Callers must hold mapMu.
+func (s *IndexSegment) unmapLocked(flush bool) error {
+	if s.RawData == nil {
+		return nil
+	}
+	if flush && !s.readOnly {
+		s.writeMu.Lock()
+		s.dirty.take()
+		s.metadataDirty = false
+		err := s.File.Sync(0, int64(len(s.RawData)))
+		s.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.File.Close(); err != nil {
 		return err
 	}
-	return s.File.Close()
+	s.File, s.RawData, s.Metadata, s.Records = nil, nil, nil, nil
+	s.cache.unmapped(s)
+	return nil
 }
 
 func (s *IndexSegment) PurgeFrom(id int64) {
@@ -182,9 +590,11 @@ func (s *IndexSegment) PurgeFrom(id int64) {
 	lr := s.LowerRecord.Load()
 	cur := lr - s.FirstRecordID
 	for i := lr; i <= id; i++ {
-		SetIndexRecordPurged(s.Records[cur*IndexRecordSize:])
+		SetIndexRecordPurged(s.Records[cur*s.RecordSize:])
 		cur++
 	}
+	purgedFrom := (lr - s.FirstRecordID) * s.RecordSize
+	s.File.Flush(s.MetadataSize+purgedFrom, cur*s.RecordSize-purgedFrom)
 
 	count := 0
 	rec := &IndexRecord{}
@@ -205,7 +615,7 @@ func (s *IndexSegment) PurgeFrom(id int64) {
 	} else {
 		cur = 0
 		for i := s.LowerRecord.Load(); i <= s.UpperRecord.Load(); i++ {
-			if !IsIndexRecordPurged(s.Records[cur*IndexRecordSize:]) {
+			if !IsIndexRecordPurged(s.Records[cur*s.RecordSize:]) {
 				s.LowerRecord.Store(i)
 				break
 			}
@@ -215,9 +625,44 @@ func (s *IndexSegment) PurgeFrom(id int64) {
 
 }
 
+// TruncateAfter discards all records with ids greater than id from the
+// segment, rewinding its cursor and upper bound accordingly.
+func (s *IndexSegment) TruncateAfter(id int64) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	keep := int64(0)
+	if s.Cursor.Load() > 0 {
+		keep = max(min(id-s.FirstRecordID+1, s.Cursor.Load()/s.RecordSize), 0)
+	}
+
+	count := int64(0)
+	for n := int64(0); n < keep; n++ {
+		if !IsIndexRecordPurged(s.Records[n*s.RecordSize:]) {
+			count++
+		}
+	}
+
+	s.Cursor.Store(keep * s.RecordSize)
+	s.UpperRecord.Store(id)
+	s.RecordsCount.Store(count)
+	if count == 0 {
+		s.LowerRecord.Store(id + 1)
+	}
+	s.FlushMetadata()
+}
+
+// Unlink removes the segment from disk. Its file is removed right away, so
+// that a new segment may be created under the same id, while its memory
+// remains mapped until all references obtained through Acquire are released.
 func (s *IndexSegment) Unlink() error {
-	if err := s.Close(); err != nil {
-		return err
+	s.refs.markUnlinked()
+	last := s.refs.releaseOwner()
+	err := s.store.Remove(s.name)
+	if last {
+		if finalizeErr := s.finalize(); err == nil {
+			err = finalizeErr
+		}
 	}
-	return os.Remove(s.Path)
+	return err
 }
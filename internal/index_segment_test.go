@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexSegmentLegacyRecords(t *testing.T) {
+	cfg := NewDummyConfig(t)
+
+	// Segment 0, sized for three legacy records, holding records 7 and 8,
+	// without the checksum flag set.
+	meta := mustByesFromHex("00000000 00000000 00000000 0000007B 00000000 00000007 00000000 00000008 00000000 00000002 00000000 00000052 00")
+	rec7 := mustByesFromHex("00000000 00000007 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000004 00")
+	rec8 := mustByesFromHex("00000000 00000008 00000000 00000000 00000000 00000000 00000000 00000004 00000000 00000004 00")
+	data := append(append(append([]byte{}, meta...), rec7...), rec8...)
+	data = append(data, make([]byte, LegacyIndexRecordSize)...)
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.WorkDir, "index0000"), data, 0644))
+
+	seg, err := NewIndexSegment(0, 0, cfg)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, seg.Close()) }()
+
+	assert.False(t, seg.Checksummed)
+	assert.Equal(t, int64(LegacyIndexRecordSize), seg.RecordSize)
+	assert.Equal(t, int64(7), seg.FirstRecordID)
+	assert.False(t, seg.FitsRecord(), "legacy segments must not accept new records")
+
+	rec := &IndexRecord{}
+	require.True(t, seg.LoadRecord(8, rec))
+	assert.Equal(t, int64(8), rec.RecordID)
+	assert.Equal(t, int64(4), rec.DataSegmentOffset)
+	assert.False(t, rec.Checksummed)
+}
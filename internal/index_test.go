@@ -1,12 +1,19 @@
 package internal
 
 import (
+	"context"
 	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/heyvito/wal/errors"
 )
 
 func TestIndexNew(t *testing.T) {
@@ -78,6 +85,29 @@ func TestIndexAppend(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestIndexClosed(t *testing.T) {
+	for name, opts := range map[string][]DummyOpt{
+		"Direct":       nil,
+		"Group commit": {WithGroupCommit(8, 0)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			idx, err := NewIndex(NewDummyConfig(t, opts...))
+			require.NoError(t, err)
+			require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+			require.NoError(t, idx.Close())
+
+			assert.ErrorIs(t, idx.Append(randomData(t, 8), &IndexRecord{}), errors.ErrClosed)
+			err = idx.AppendBatch([][]byte{randomData(t, 8)}, []*IndexRecord{{}})
+			assert.ErrorIs(t, err, errors.ErrClosed)
+			_, err = idx.NewObjectWriter()
+			assert.ErrorIs(t, err, errors.ErrClosed)
+			assert.ErrorIs(t, idx.Sync(), errors.ErrClosed)
+			assert.ErrorIs(t, idx.VacuumObjects(0, true), errors.ErrClosed)
+			assert.ErrorIs(t, idx.TruncateAfter(-1), errors.ErrClosed)
+		})
+	}
+}
+
 func TestIndexRead(t *testing.T) {
 	conf := NewDummyConfig(t)
 	idx, err := NewIndex(conf)
@@ -105,3 +135,855 @@ func TestIndexRead(t *testing.T) {
 	assert.True(t, cur.Next())
 	assert.Equal(t, rec.RecordID, cur.Offset())
 }
+
+func TestIndexReadCorrupted(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	rec := &IndexRecord{}
+	err = idx.Append(randomData(t, 32), rec)
+	require.NoError(t, err)
+	assert.True(t, rec.Checksummed)
+
+	seg, ok := idx.dm.Segments.Load(rec.DataSegmentStartID)
+	require.True(t, ok)
+	seg.Records[rec.DataSegmentOffset+3] ^= 0xFF
+
+	loaded := &IndexRecord{}
+	require.NoError(t, idx.LookupMeta(rec.RecordID, loaded))
+	_, err = idx.ReadRecord(loaded)
+	var corrupted errors.CorruptedRecordError
+	require.ErrorAs(t, err, &corrupted)
+	assert.Equal(t, rec.RecordID, corrupted.RecordID)
+	assert.Equal(t, rec.DataSegmentStartID, corrupted.SegmentID)
+	assert.Equal(t, rec.DataSegmentOffset, corrupted.Offset)
+
+	cur := idx.ReadObjects(rec.RecordID, true)
+	require.True(t, cur.Next())
+	_, err = cur.Read()
+	require.ErrorAs(t, err, &corrupted)
+	assert.False(t, cur.Next())
+	assert.ErrorAs(t, cur.Err(), &corrupted)
+
+	// Repositioning the cursor clears the error.
+	cur.SeekTo(rec.RecordID)
+	assert.NoError(t, cur.Err())
+	require.True(t, cur.Next())
+	assert.Equal(t, rec.RecordID, cur.Offset())
+}
+
+func TestIndexCursorErrors(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	for range 6 {
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	}
+
+	t.Run("End of index", func(t *testing.T) {
+		cur := idx.ReadObjects(5, true)
+		assert.True(t, cur.Next())
+		assert.False(t, cur.Next())
+		assert.NoError(t, cur.Err())
+	})
+
+	t.Run("Purged records are skipped", func(t *testing.T) {
+		seg, ok := idx.SegmentForID(4)
+		require.True(t, ok)
+		SetIndexRecordPurged(seg.Records[(4-seg.FirstRecordID)*seg.RecordSize:])
+
+		cur := idx.ReadObjects(3, true)
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(3), cur.Offset())
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(5), cur.Offset())
+		assert.False(t, cur.Next())
+		assert.NoError(t, cur.Err())
+	})
+
+	t.Run("Vacuumed under the cursor", func(t *testing.T) {
+		cur := idx.ReadObjects(0, true)
+		require.True(t, cur.Next())
+		require.NoError(t, idx.VacuumObjects(2, true))
+		assert.False(t, cur.Next())
+		var vacuumed errors.VacuumedError
+		require.ErrorAs(t, cur.Err(), &vacuumed)
+		assert.Equal(t, int64(1), vacuumed.RecordID)
+	})
+
+	t.Run("Vacuumed before the cursor", func(t *testing.T) {
+		cur := idx.ReadObjects(0, true)
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(3), cur.Offset())
+		assert.NoError(t, cur.Err())
+	})
+
+	t.Run("Closed index", func(t *testing.T) {
+		cur := idx.ReadObjects(3, true)
+		require.NoError(t, idx.Close())
+		assert.False(t, cur.Next())
+		assert.ErrorIs(t, cur.Err(), errors.ErrClosed)
+	})
+}
+
+func TestIndexRecoverDataCursor(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	records := [][]byte{randomData(t, 16), randomData(t, 16)}
+	for _, data := range records {
+		require.NoError(t, idx.Append(data, &IndexRecord{}))
+	}
+
+	// Write data that never gets published to the index, as an interrupted
+	// append would.
+	require.NoError(t, idx.dm.Write(randomData(t, 10), &IndexRecord{}))
+	require.NoError(t, idx.Close())
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(32), idx.dm.CurrentSegment.Cursor.Load())
+	require.NoError(t, idx.Close())
+
+	// Simulate a crash before the data segment cursor was ever persisted.
+	path := filepath.Join(conf.WorkDir, "data0000")
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	clear(raw[dataSegmentOffsets.Cursor : dataSegmentOffsets.Cursor+8])
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+	assert.Equal(t, int64(32), idx.dm.CurrentSegment.Cursor.Load())
+
+	rec := &IndexRecord{}
+	require.NoError(t, idx.Append(randomData(t, 16), rec))
+	assert.Equal(t, int64(32), rec.DataSegmentOffset)
+
+	for id, data := range records {
+		require.NoError(t, idx.LookupMeta(int64(id), rec))
+		r, err := idx.ReadRecord(rec)
+		require.NoError(t, err)
+		read, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+	}
+}
+
+func TestIndexRecoverDataErrors(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	records := [][]byte{randomData(t, 16), randomData(t, 16), randomData(t, 16)}
+	for _, data := range records {
+		require.NoError(t, idx.Append(data, &IndexRecord{}))
+	}
+	// The newest segment only holds an empty record, so that recovery looks
+	// up records held by the previous one.
+	require.NoError(t, idx.Append(nil, &IndexRecord{}))
+	require.NoError(t, idx.Close())
+
+	// Failing to read those records fails recovery, instead of discarding
+	// their data.
+	ioErr := syscall.EIO
+	failing := *conf
+	failing.Store = failingStore{SegmentStore: NewMMapStore(conf.WorkDir), name: "index0000", err: ioErr}
+	_, err = NewIndex(&failing)
+	require.ErrorIs(t, err, ioErr)
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+	assert.Equal(t, int64(48), idx.dm.CurrentSegment.Cursor.Load())
+	for id, expected := range records {
+		rec := &IndexRecord{}
+		require.NoError(t, idx.LookupMeta(int64(id), rec))
+		r, err := idx.ReadRecord(rec)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, expected, data)
+	}
+}
+
+func TestIndexAppendBatch(t *testing.T) {
+	conf := NewDummyConfig(t, WithIndexSegmentSize(IndexRecordSize*4))
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+
+	// Three records do not fit the remaining space of the first segment, so
+	// the batch must be published as a whole in the next one.
+	batch := [][]byte{randomData(t, 8), randomData(t, 80), randomData(t, 8)}
+	recs := []*IndexRecord{{}, {}, {}}
+	require.NoError(t, idx.AppendBatch(batch, recs))
+	assert.Equal(t, int64(1), idx.CurrentSegment.SegmentID)
+	assert.Equal(t, int64(4), idx.MaxRecord.Load())
+
+	for n, rec := range recs {
+		assert.Equal(t, int64(2+n), rec.RecordID)
+		loaded := &IndexRecord{}
+		require.NoError(t, idx.LookupMeta(rec.RecordID, loaded))
+		r, err := idx.ReadRecord(loaded)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, batch[n], data)
+	}
+
+	big := make([][]byte, 5)
+	err = idx.AppendBatch(big, make([]*IndexRecord, 5))
+	var tooLarge errors.BatchTooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	assert.Equal(t, int64(4), tooLarge.Limit)
+	assert.Equal(t, int64(4), idx.MaxRecord.Load())
+
+	// Data written by a failed batch is discarded.
+	segID, cursor := idx.dm.CurrentSegment.SegmentID, idx.dm.CurrentSegment.Cursor.Load()
+	entries, err := os.ReadDir(conf.WorkDir)
+	require.NoError(t, err)
+	preallocateFile = func(*os.File, int64) error { return syscall.ENOSPC }
+	defer func() { preallocateFile = preallocate }()
+	err = idx.AppendBatch([][]byte{randomData(t, 200)}, []*IndexRecord{{}})
+	assert.ErrorIs(t, err, errors.ErrNoSpace)
+	assert.Equal(t, int64(4), idx.MaxRecord.Load())
+	assert.Equal(t, segID, idx.dm.CurrentSegment.SegmentID)
+	assert.Equal(t, cursor, idx.dm.CurrentSegment.Cursor.Load())
+	after, err := os.ReadDir(conf.WorkDir)
+	require.NoError(t, err)
+	assert.Len(t, after, len(entries))
+
+	preallocateFile = preallocate
+	rec := &IndexRecord{}
+	require.NoError(t, idx.Append(randomData(t, 8), rec))
+	assert.Equal(t, int64(5), rec.RecordID)
+	assert.Equal(t, segID, rec.DataSegmentStartID)
+	assert.Equal(t, cursor, rec.DataSegmentOffset)
+}
+
+func TestIndexObjectWriter(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	require.NoError(t, idx.Append(randomData(t, 16), &IndexRecord{}))
+
+	t.Run("Close publishes the object", func(t *testing.T) {
+		w, err := idx.NewObjectWriter()
+		require.NoError(t, err)
+		var expected []byte
+		for range 5 {
+			chunk := randomData(t, 30)
+			expected = append(expected, chunk...)
+			_, err = w.Write(chunk)
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+
+		rec := w.Record()
+		assert.Equal(t, int64(1), rec.RecordID)
+		assert.Equal(t, int64(150), rec.Size)
+		assert.Equal(t, int64(0), rec.DataSegmentStartID)
+		assert.Equal(t, int64(16), rec.DataSegmentOffset)
+		assert.Equal(t, int64(2), rec.DataSegmentEndID)
+
+		loaded := &IndexRecord{}
+		require.NoError(t, idx.LookupMeta(1, loaded))
+		r, err := idx.ReadRecord(loaded)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, expected, data)
+	})
+
+	t.Run("Abort discards the object", func(t *testing.T) {
+		w, err := idx.NewObjectWriter()
+		require.NoError(t, err)
+		_, err = w.Write(randomData(t, 200))
+		require.NoError(t, err)
+		require.NoError(t, w.Abort())
+		assert.ErrorIs(t, w.Close(), errors.ErrClosed)
+
+		assert.Equal(t, int64(1), idx.MaxRecord.Load())
+		assert.Equal(t, int64(2), idx.dm.CurrentSegment.SegmentID)
+		assert.Equal(t, int64(38), idx.dm.CurrentSegment.Cursor.Load())
+		assert.NoFileExists(t, filepath.Join(conf.WorkDir, "data0004"))
+
+		rec := &IndexRecord{}
+		require.NoError(t, idx.Append(randomData(t, 8), rec))
+		assert.Equal(t, int64(2), rec.RecordID)
+		assert.Equal(t, int64(38), rec.DataSegmentOffset)
+	})
+
+	t.Run("Other writes wait for the writer", func(t *testing.T) {
+		w, err := idx.NewObjectWriter()
+		require.NoError(t, err)
+		payload := randomData(t, 200)
+		_, err = w.Write(payload[:100])
+		require.NoError(t, err)
+
+		data := randomData(t, 8)
+		appended := make(chan error, 1)
+		go func() { appended <- idx.Append(data, &IndexRecord{}) }()
+
+		// Syncing, snapshots, and vacuum proceed meanwhile, and the latter
+		// keeps the segments being written.
+		require.NoError(t, idx.Sync())
+		require.NoError(t, idx.ReadObjectsSnapshot(0, true).Close())
+		require.NoError(t, idx.VacuumObjects(2, true))
+		select {
+		case err := <-appended:
+			t.Fatalf("append finished while the writer was open: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		_, err = w.Write(payload[100:])
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.NoError(t, <-appended)
+		assert.Equal(t, int64(3), w.Record().RecordID)
+		assert.Equal(t, int64(4), idx.MaxRecord.Load())
+
+		rec := &IndexRecord{}
+		require.NoError(t, idx.LookupMeta(3, rec))
+		r, err := idx.ReadRecord(rec)
+		require.NoError(t, err)
+		read, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, payload, read)
+	})
+
+	t.Run("Closing the index aborts the writer", func(t *testing.T) {
+		conf := NewDummyConfig(t)
+		idx, err := NewIndex(conf)
+		require.NoError(t, err)
+		w, err := idx.NewObjectWriter()
+		require.NoError(t, err)
+		_, err = w.Write(randomData(t, 100))
+		require.NoError(t, err)
+
+		require.NoError(t, idx.Close())
+		_, err = w.Write(randomData(t, 8))
+		assert.ErrorIs(t, err, errors.ErrClosed)
+		assert.ErrorIs(t, w.Close(), errors.ErrClosed)
+
+		idx, err = NewIndex(conf)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, idx.Close()) }()
+		assert.True(t, idx.IsEmpty())
+		assert.Equal(t, int64(0), idx.dm.CurrentSegment.Cursor.Load())
+	})
+
+	t.Run("Failing to close discards the object", func(t *testing.T) {
+		conf := NewDummyConfig(t, WithIndexSegmentSize(IndexRecordSize))
+		idx, err := NewIndex(conf)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, idx.Close()) }()
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+
+		w, err := idx.NewObjectWriter()
+		require.NoError(t, err)
+		_, err = w.Write(randomData(t, 100))
+		require.NoError(t, err)
+
+		// Publishing the object requires a new index segment.
+		preallocateFile = func(*os.File, int64) error { return syscall.ENOSPC }
+		defer func() { preallocateFile = preallocate }()
+		assert.ErrorIs(t, w.Close(), errors.ErrNoSpace)
+		assert.ErrorIs(t, w.Abort(), errors.ErrClosed)
+		assert.Equal(t, int64(0), idx.dm.CurrentSegment.SegmentID)
+		assert.Equal(t, int64(8), idx.dm.CurrentSegment.Cursor.Load())
+		assert.NoFileExists(t, filepath.Join(conf.WorkDir, "data0001"))
+
+		preallocateFile = preallocate
+		rec := &IndexRecord{}
+		require.NoError(t, idx.Append(randomData(t, 8), rec))
+		assert.Equal(t, int64(1), rec.RecordID)
+		assert.Equal(t, int64(8), rec.DataSegmentOffset)
+	})
+}
+
+func TestIndexCursorNextWait(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	cur := idx.ReadObjects(0, true)
+
+	t.Run("Wakes on append", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			assert.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.True(t, cur.NextWait(ctx))
+		assert.Equal(t, int64(0), cur.Offset())
+	})
+
+	t.Run("Context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.False(t, cur.NextWait(ctx))
+		assert.ErrorIs(t, cur.Err(), context.DeadlineExceeded)
+
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+		require.True(t, cur.Next())
+		assert.NoError(t, cur.Err())
+		assert.Equal(t, int64(1), cur.Offset())
+	})
+
+	t.Run("Wakes on close", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			assert.NoError(t, idx.Close())
+		}()
+		assert.False(t, cur.NextWait(context.Background()))
+		assert.ErrorIs(t, cur.Err(), errors.ErrClosed)
+	})
+}
+
+func TestIndexCursorSeek(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	for range 10 {
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	}
+	require.NoError(t, idx.VacuumObjects(2, true))
+	seg, ok := idx.SegmentForID(6)
+	require.True(t, ok)
+	SetIndexRecordPurged(seg.Records[(6-seg.FirstRecordID)*seg.RecordSize:])
+
+	collect := func(cur IndexCursor, step func() bool) []int64 {
+		var ids []int64
+		for step() {
+			ids = append(ids, cur.Offset())
+		}
+		require.NoError(t, cur.Err())
+		return ids
+	}
+
+	cur := idx.ReadObjects(0, true)
+
+	t.Run("Last records", func(t *testing.T) {
+		cur.SeekToLast()
+		assert.False(t, cur.Next())
+		assert.Equal(t, []int64{9, 8, 7, 5, 4, 3}, collect(cur, cur.Prev))
+		assert.Equal(t, []int64{3, 4, 5, 7, 8, 9}, collect(cur, cur.Next))
+	})
+
+	t.Run("Change direction", func(t *testing.T) {
+		cur.SeekTo(5)
+		require.True(t, cur.Next())
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(7), cur.Offset())
+		require.True(t, cur.Prev())
+		assert.Equal(t, int64(5), cur.Offset())
+		require.True(t, cur.Prev())
+		assert.Equal(t, int64(4), cur.Offset())
+	})
+
+	t.Run("Clamped to bounds", func(t *testing.T) {
+		cur.SeekTo(0)
+		assert.False(t, cur.Prev())
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(3), cur.Offset())
+
+		cur.SeekTo(100)
+		assert.False(t, cur.Next())
+		require.True(t, cur.Prev())
+		assert.Equal(t, int64(9), cur.Offset())
+
+		cur.SeekToFirst()
+		require.True(t, cur.Next())
+		assert.Equal(t, int64(3), cur.Offset())
+	})
+
+	t.Run("Seeking clears errors", func(t *testing.T) {
+		cur.SeekTo(4)
+		require.True(t, cur.Next())
+		require.NoError(t, idx.VacuumObjects(5, true))
+		assert.False(t, cur.Next())
+		require.ErrorAs(t, cur.Err(), &errors.VacuumedError{})
+
+		cur.SeekToFirst()
+		assert.NoError(t, cur.Err())
+		assert.Equal(t, []int64{7, 8, 9}, collect(cur, cur.Next))
+	})
+}
+
+func TestIndexRemovesPurgedSegments(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	for range 7 {
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	}
+
+	// Simulate a vacuum interrupted before segments were unlinked.
+	for id := int64(0); id < 2; id++ {
+		seg, ok := idx.Segments.Load(id)
+		require.True(t, ok)
+		seg.Purged = true
+		seg.FlushMetadata()
+	}
+	require.NoError(t, idx.Close())
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	assert.NoFileExists(t, filepath.Join(conf.WorkDir, "index0000"))
+	assert.NoFileExists(t, filepath.Join(conf.WorkDir, "index0001"))
+	assert.Equal(t, int64(2), idx.MinSegment.Load())
+	assert.Equal(t, int64(6), idx.MinimumRecordID())
+	assert.Equal(t, int64(6), idx.MaxRecord.Load())
+}
+
+func TestIndexMappingBudget(t *testing.T) {
+	conf := NewDummyConfig(t, WithMappingBudget(0, 3))
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	var written [][]byte
+	for range 20 {
+		data := randomData(t, 40)
+		require.NoError(t, idx.Append(data, &IndexRecord{}))
+		written = append(written, data)
+	}
+	assert.LessOrEqual(t, idx.cache.open, 3)
+
+	readAll := func() {
+		rec := &IndexRecord{}
+		for id, data := range written {
+			require.NoError(t, idx.LookupMeta(int64(id), rec))
+			reader, err := idx.ReadRecord(rec)
+			require.NoError(t, err)
+			read, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, data, read)
+		}
+		assert.LessOrEqual(t, idx.cache.open, 3)
+	}
+	readAll()
+	require.NoError(t, idx.Close())
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	// Only segments being written to are mapped at startup.
+	assert.Equal(t, 2, idx.cache.open)
+	readAll()
+
+	require.NoError(t, idx.TruncateAfter(15))
+	written = written[:16]
+	readAll()
+
+	data := randomData(t, 40)
+	require.NoError(t, idx.Append(data, &IndexRecord{}))
+	written = append(written, data)
+	readAll()
+
+	require.NoError(t, idx.VacuumObjects(9, true))
+	assert.Equal(t, int64(10), idx.MinimumRecordID())
+	rec := &IndexRecord{}
+	require.NoError(t, idx.LookupMeta(16, rec))
+	reader, err := idx.ReadRecord(rec)
+	require.NoError(t, err)
+	read, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+}
+
+func TestIndexManifest(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	var written [][]byte
+	for range 10 {
+		data := randomData(t, 40)
+		require.NoError(t, idx.Append(data, &IndexRecord{}))
+		written = append(written, data)
+	}
+	require.NoError(t, idx.VacuumObjects(2, true))
+
+	type segmentState struct{ first, lower, upper, count, cursor int64 }
+	states := map[int64]segmentState{}
+	for id, seg := range idx.Segments.Range() {
+		states[id] = segmentState{seg.FirstRecordID, seg.LowerRecord.Load(), seg.UpperRecord.Load(), seg.RecordsCount.Load(), seg.Cursor.Load()}
+	}
+	require.NoError(t, idx.Close())
+	manifestPath := filepath.Join(conf.WorkDir, manifestFileName)
+	assert.FileExists(t, manifestPath)
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	assert.NoFileExists(t, manifestPath)
+	for id, seg := range idx.Segments.Range() {
+		assert.Equal(t, states[id], segmentState{seg.FirstRecordID, seg.LowerRecord.Load(), seg.UpperRecord.Load(), seg.RecordsCount.Load(), seg.Cursor.Load()})
+	}
+	assert.Len(t, states, int(idx.LoadedSegments.Load()))
+
+	rec := &IndexRecord{}
+	for id := int64(3); id < 10; id++ {
+		require.NoError(t, idx.LookupMeta(id, rec))
+		reader, err := idx.ReadRecord(rec)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, written[id], data)
+	}
+	require.NoError(t, idx.Close())
+
+	// Invalid manifests are ignored in favour of segment headers.
+	require.NoError(t, os.WriteFile(manifestPath, []byte("garbage"), 0644))
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+	assert.Equal(t, int64(9), idx.MaxRecord.Load())
+	assert.Equal(t, int64(3), idx.MinimumRecordID())
+}
+
+func TestIndexIgnoresUnrelatedFiles(t *testing.T) {
+	conf := NewDummyConfig(t)
+	for _, name := range []string{"index.bak", "data-old", "datafile", "notes"} {
+		require.NoError(t, os.WriteFile(filepath.Join(conf.WorkDir, name), []byte("unrelated"), 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(conf.WorkDir, "index0009"), 0755))
+
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	require.NoError(t, idx.Close())
+
+	assert.FileExists(t, filepath.Join(conf.WorkDir, "index.bak"))
+	assert.FileExists(t, filepath.Join(conf.WorkDir, "data-old"))
+	assert.DirExists(t, filepath.Join(conf.WorkDir, "index0009"))
+}
+
+// closeTracker is a segment recording whether it was closed.
+type closeTracker struct{ closed bool }
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestIndexLoadSegmentsFailure(t *testing.T) {
+	ids := []int64{0, 1, 2, 3, 4, 5, 6, 7}
+	trackers := make([]*closeTracker, len(ids))
+	for n := range trackers {
+		trackers[n] = &closeTracker{}
+	}
+	segments, err := loadSegments(ids, func(id int64) (*closeTracker, error) {
+		if id == 5 {
+			return nil, syscall.EIO
+		}
+		return trackers[id], nil
+	})
+	require.ErrorIs(t, err, syscall.EIO)
+	assert.Nil(t, segments)
+	for id, tracker := range trackers {
+		assert.Equalf(t, id != 5, tracker.closed, "segment %d", id)
+	}
+}
+
+func TestIndexMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	conf := NewDummyConfig(t, WithStore(store))
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+
+	for range 5 {
+		require.NoError(t, idx.Append(randomData(t, 40), &IndexRecord{}))
+	}
+	require.NoError(t, idx.Close())
+
+	entries, err := os.ReadDir(conf.WorkDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+	assert.Equal(t, int64(4), idx.MaxRecord.Load())
+}
+
+func TestIndexNoSpace(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	entries, err := os.ReadDir(conf.WorkDir)
+	require.NoError(t, err)
+
+	preallocateFile = func(*os.File, int64) error { return syscall.ENOSPC }
+	defer func() { preallocateFile = preallocate }()
+
+	for err == nil {
+		err = idx.Append(randomData(t, 40), &IndexRecord{})
+	}
+	assert.ErrorIs(t, err, errors.ErrNoSpace)
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+
+	// Segments that could not be reserved are not left behind.
+	after, err := os.ReadDir(conf.WorkDir)
+	require.NoError(t, err)
+	assert.Len(t, after, len(entries))
+
+	preallocateFile = preallocate
+	require.NoError(t, idx.Append(randomData(t, 40), &IndexRecord{}))
+
+	// Files opened before failing to create the first index segment of an
+	// empty directory are closed.
+	preallocateFile = func(fd *os.File, size int64) error {
+		if strings.HasPrefix(filepath.Base(fd.Name()), indexSegmentPrefix) {
+			return syscall.ENOSPC
+		}
+		return preallocate(fd, size)
+	}
+	empty := NewDummyConfig(t)
+	store := &openTrackingStore{SegmentStore: NewMMapStore(empty.WorkDir)}
+	empty.Store = store
+	_, err = NewIndex(empty)
+	assert.ErrorIs(t, err, errors.ErrNoSpace)
+	assert.Zero(t, store.open.Load())
+}
+
+func TestIndexReadOnly(t *testing.T) {
+	conf := NewDummyConfig(t)
+	roConf := *conf
+	roConf.ReadOnly = true
+
+	_, err := NewIndex(NewDummyConfig(t, func(d *DummyConfig) {
+		d.WorkDir = filepath.Join(t.TempDir(), "missing")
+		d.ReadOnly = true
+	}))
+	require.Error(t, err)
+
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	ro, err := NewIndex(roConf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ro.Close()) }()
+	assert.True(t, ro.IsEmpty())
+
+	var written [][]byte
+	for range 10 {
+		data := randomData(t, 40)
+		require.NoError(t, idx.Append(data, &IndexRecord{}))
+		written = append(written, data)
+	}
+
+	require.NoError(t, ro.Refresh())
+	assert.Equal(t, int64(9), ro.MaxRecord.Load())
+	assert.Equal(t, int64(10), ro.CountObjects(0, true))
+	readAll := func(from int) {
+		rec := &IndexRecord{}
+		for id := from; id < len(written); id++ {
+			require.NoError(t, ro.LookupMeta(int64(id), rec))
+			reader, err := ro.ReadRecord(rec)
+			require.NoError(t, err)
+			read, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, written[id], read)
+		}
+	}
+	readAll(0)
+
+	assert.ErrorIs(t, ro.Append(randomData(t, 40), &IndexRecord{}), errors.ErrReadOnly)
+	assert.ErrorIs(t, ro.AppendBatch([][]byte{{1}}, []*IndexRecord{{}}), errors.ErrReadOnly)
+	assert.ErrorIs(t, ro.VacuumObjects(3, true), errors.ErrReadOnly)
+	assert.ErrorIs(t, ro.TruncateAfter(3), errors.ErrReadOnly)
+	_, err = ro.NewObjectWriter()
+	assert.ErrorIs(t, err, errors.ErrReadOnly)
+
+	// Vacuums and truncations made by the writer are followed as well.
+	require.NoError(t, idx.VacuumObjects(5, true))
+	require.NoError(t, idx.TruncateAfter(8))
+	written = written[:9]
+	require.NoError(t, ro.Refresh())
+	assert.Equal(t, idx.MinimumRecordID(), ro.MinimumRecordID())
+	assert.Equal(t, int64(8), ro.MaxRecord.Load())
+	readAll(int(ro.MinimumRecordID()))
+	assert.Error(t, ro.LookupMeta(0, &IndexRecord{}))
+
+	// Tailing cursors are woken by refreshes.
+	cur := ro.ReadObjects(8, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() { _ = idx.Append([]byte("tail"), &IndexRecord{}) }()
+	require.True(t, cur.NextWait(ctx))
+	assert.Equal(t, int64(9), cur.Offset())
+}
+
+func TestIndexEpoch(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), idx.Epoch())
+	for range 10 {
+		require.NoError(t, idx.Append(randomData(t, 40), &IndexRecord{}))
+	}
+	require.Greater(t, idx.LoadedSegments.Load(), int32(1))
+	require.NoError(t, idx.Close())
+
+	// Segments keep the epoch of the last writer appending to them, whether
+	// loaded from the manifest or from their headers.
+	idx, err = NewIndex(conf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), idx.Epoch())
+	for id, seg := range idx.Segments.Range() {
+		if id == idx.CurrentSegment.SegmentID {
+			assert.Equal(t, int64(2), seg.Epoch)
+		} else {
+			assert.Equal(t, int64(1), seg.Epoch)
+		}
+	}
+
+	// A writer opening the WAL fences out the one that opened it before.
+	next, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, next.Close()) }()
+	assert.Equal(t, int64(3), next.Epoch())
+	assert.Equal(t, int64(3), next.CurrentSegment.Epoch)
+
+	stale := errors.StaleEpochError{Epoch: 2, Current: 3}
+	assert.Equal(t, stale, idx.Append(randomData(t, 40), &IndexRecord{}))
+	assert.Equal(t, stale, idx.AppendBatch([][]byte{{1}}, []*IndexRecord{{}}))
+	assert.Equal(t, stale, idx.VacuumObjects(3, true))
+	assert.Equal(t, stale, idx.TruncateAfter(3))
+	_, err = idx.NewObjectWriter()
+	assert.Equal(t, stale, err)
+	require.NoError(t, idx.Close())
+
+	require.NoError(t, next.Append(randomData(t, 40), &IndexRecord{}))
+	assert.Equal(t, int64(10), next.MaxRecord.Load())
+
+	ro, err := NewIndex(NewDummyConfig(t, func(d *DummyConfig) {
+		d.WorkDir = conf.WorkDir
+		d.ReadOnly = true
+	}))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ro.Close()) }()
+	assert.Equal(t, int64(3), ro.Epoch())
+	assert.Equal(t, int64(10), ro.MaxRecord.Load())
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// manifestFileName is the name of the file holding the metadata of every
+// segment, written when the index is closed.
+const manifestFileName = "manifest"
+
+// manifestVersion holds the version of manifests written by this package.
+const manifestVersion = 1
+
+var manifestMagic = []byte("WALM")
+
+// manifestHeaderSize holds the size of the manifest's magic, version and
+// entry counts.
+const manifestHeaderSize = 4 + 1 + 4 + 4
+
+// Index entries hold the segment's header followed by its first record id.
+// Data entries hold the segment's header.
+const (
+	manifestIndexEntrySize = IndexSegmentEpochMetadataSize + 8
+	manifestDataEntrySize  = dataSegmentMetadataSize
+)
+
+// manifest holds the metadata of segments present when the index was last
+// closed, keyed by segment id. It allows segments to be loaded without
+// reading their headers. The manifest is removed once loaded, so that a
+// process that does not shut down cleanly leaves no stale manifest behind.
+type manifest struct {
+	index map[int64][]byte
+	data  map[int64][]byte
+}
+
+// readManifest reads the manifest from a given store. Returns a nil
+// manifest in case none exists.
+func readManifest(store SegmentStore) (*manifest, error) {
+	b, err := store.ReadFile(manifestFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(b) < manifestHeaderSize+4 || !bytes.Equal(b[:4], manifestMagic) {
+		return nil, fmt.Errorf("invalid manifest header")
+	}
+	if b[4] != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", b[4])
+	}
+	body, sum := b[:len(b)-4], be.Uint32(b[len(b)-4:])
+	if Checksum(body) != sum {
+		return nil, fmt.Errorf("manifest checksum mismatch")
+	}
+	indexCount, dataCount := int(be.Uint32(b[5:])), int(be.Uint32(b[9:]))
+	if len(body) != manifestHeaderSize+indexCount*manifestIndexEntrySize+dataCount*manifestDataEntrySize {
+		return nil, fmt.Errorf("invalid manifest length")
+	}
+
+	m := &manifest{
+		index: make(map[int64][]byte, indexCount),
+		data:  make(map[int64][]byte, dataCount),
+	}
+	body = body[manifestHeaderSize:]
+	for range indexCount {
+		entry := body[:manifestIndexEntrySize]
+		m.index[int64(be.Uint64(entry[indexSegmentOffsets.SegmentID:]))] = entry
+		body = body[manifestIndexEntrySize:]
+	}
+	for range dataCount {
+		entry := body[:manifestDataEntrySize]
+		m.data[int64(be.Uint64(entry[dataSegmentOffsets.SegmentID:]))] = entry
+		body = body[manifestDataEntrySize:]
+	}
+	return m, nil
+}
+
+// indexEntry returns the manifest entry for a given index segment, if any.
+func (m *manifest) indexEntry(id int64) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+	e, ok := m.index[id]
+	return e, ok
+}
+
+// dataEntry returns the manifest entry for a given data segment, if any.
+func (m *manifest) dataEntry(id int64) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+	e, ok := m.data[id]
+	return e, ok
+}
+
+// writeManifest atomically replaces the manifest in a given store with one
+// describing the provided segments.
+func writeManifest(store SegmentStore, index []*IndexSegment, data []*DataSegment) error {
+	size := manifestHeaderSize + len(index)*manifestIndexEntrySize + len(data)*manifestDataEntrySize + 4
+	b := make([]byte, 0, size)
+	b = append(b, manifestMagic...)
+	b = append(b, manifestVersion)
+	b = be.AppendUint32(b, uint32(len(index)))
+	b = be.AppendUint32(b, uint32(len(data)))
+	for _, seg := range index {
+		entry := make([]byte, manifestIndexEntrySize)
+		seg.encodeMetadata(entry)
+		be.PutUint64(entry[IndexSegmentEpochMetadataSize:], uint64(seg.FirstRecordID))
+		b = append(b, entry...)
+	}
+	for _, seg := range data {
+		entry := make([]byte, manifestDataEntrySize)
+		seg.encodeMetadata(entry)
+		b = append(b, entry...)
+	}
+	b = be.AppendUint32(b, Checksum(b))
+	return store.WriteFile(manifestFileName, b)
+}
+
+// removeManifest removes the manifest from a given store, if present.
+func removeManifest(store SegmentStore) error {
+	err := store.Remove(manifestFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return store.Sync()
+}
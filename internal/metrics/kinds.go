@@ -7,6 +7,10 @@ const (
 	CommonWriteObjectLatency
 	CommonWriteObjectFailures
 
+	CommonWriteBatchCalls
+	CommonWriteBatchLatency
+	CommonWriteBatchFailures
+
 	CommonReadObjectCalls
 	CommonReadObjectLatency
 	CommonReadObjectFailures
@@ -30,12 +34,22 @@ const (
 	CommonIndexSegmentsCount
 	CommonDataSegmentsCount
 	CommonRecordsCount
+	CommonSegmentsPendingDeletion
+	CommonSegmentMaps
+	CommonSegmentUnmaps
+	CommonMappedBytes
 
 	IndexAppendLatency
 	IndexAppendCalls
+	IndexAppendBatchLatency
+	IndexAppendBatchCalls
 	IndexLookupLatency
 	IndexCountObjectsLatency
 	IndexVacuumObjectsLatency
+	IndexTruncateAfterLatency
+	IndexSyncCalls
+	IndexSyncLatency
+	IndexGroupCommitBatchSize
 
 	DataManagerWriteLatency
 	DataManagerWriteCalls
@@ -43,6 +57,7 @@ const (
 	DataManagerReadCalls
 	DataManagerVacuumCalls
 	DataManagerVacuumLatency
+	DataManagerChecksumFailures
 
 	IndexSegmentFlushMetaCalls
 	IndexSegmentFlushMetaLatency
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	errs "errors"
+	"hash/crc32"
+	"sync"
+
+	"github.com/heyvito/wal/errors"
+	"github.com/heyvito/wal/internal/metrics"
+)
+
+// ObjectWriter streams an object of unknown size directly into data
+// segments. The object's index record is only allocated and published once
+// Close is called. As an object's data is stored contiguously, other writes
+// wait for the ObjectWriter to be either closed or aborted before writing any
+// data; the index's write lock itself is only held while reserving the
+// object's position and publishing its record. Closing the index aborts it.
+type ObjectWriter struct {
+	index *Index
+	done  chan struct{}
+
+	// mu serializes calls to the writer, and guards the fields below.
+	mu     sync.Mutex
+	rec    IndexRecord
+	crc    uint32
+	closed bool
+}
+
+// NewObjectWriter reserves the end of the data stream and returns a new
+// ObjectWriter positioned at it. Waits for the ObjectWriter currently open,
+// if any, to be closed or aborted.
+func (i *Index) NewObjectWriter() (*ObjectWriter, error) {
+	if i.readOnly {
+		return nil, errors.ErrReadOnly
+	}
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	if err := i.waitStreamLocked(); err != nil {
+		return nil, err
+	}
+	if err := i.checkEpoch(); err != nil {
+		return nil, err
+	}
+	w := &ObjectWriter{index: i, done: make(chan struct{})}
+	if err := i.dm.Begin(&w.rec); err != nil {
+		return nil, err
+	}
+	i.stream = w
+	return w, nil
+}
+
+// waitStreamLocked waits for the ObjectWriter streaming into the data
+// manager, if any, to be closed or aborted, releasing writeMu meanwhile.
+// Returns ErrClosed in case the index was closed while waiting. Callers must
+// hold writeMu.
+func (i *Index) waitStreamLocked() error {
+	for i.stream != nil {
+		done := i.stream.done
+		i.writeMu.Unlock()
+		<-done
+		i.writeMu.Lock()
+	}
+	if i.closed.Load() {
+		return errors.ErrClosed
+	}
+	return nil
+}
+
+// abortStream aborts the ObjectWriter streaming into the data manager, if
+// any. Used when closing the index.
+func (i *Index) abortStream() {
+	i.writeMu.Lock()
+	w := i.stream
+	i.writeMu.Unlock()
+	if w != nil {
+		if err := w.Abort(); err != nil && err != errors.ErrClosed {
+			i.log.Error(err, "Failed aborting object writer")
+		}
+	}
+}
+
+// Write appends p to the object being written.
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errors.ErrClosed
+	}
+	if err := w.index.checkEpoch(); err != nil {
+		return 0, err
+	}
+	if err := w.index.dm.Append(p, &w.rec); err != nil {
+		return 0, err
+	}
+	w.crc = crc32.Update(w.crc, crcTable, p)
+	w.rec.Size += int64(len(p))
+	return len(p), nil
+}
+
+// Close publishes the object written so far, assigning it a record id, and
+// allows other writes to proceed. In case the object cannot be published,
+// the data written so far is discarded, as by Abort.
+func (w *ObjectWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.ErrClosed
+	}
+	w.closed = true
+	i := w.index
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	defer i.endStreamLocked(w)
+	defer metrics.Measure(metrics.IndexAppendLatency)()
+	metrics.Simple(metrics.IndexAppendCalls, 0)
+
+	if err := i.checkEpoch(); err != nil {
+		return w.discardLocked(err)
+	}
+	if i.syncErr != nil {
+		return w.discardLocked(i.syncErr)
+	}
+	if !i.CurrentSegment.FitsRecord() {
+		if err := i.Rotate(); err != nil {
+			return w.discardLocked(err)
+		}
+	}
+
+	w.rec.RecordID = i.written + 1
+	w.rec.Purged = false
+	w.rec.Checksum = w.crc
+	w.rec.Checksummed = true
+
+	i.CurrentSegment.WriteRecord(&w.rec)
+	i.written = w.rec.RecordID
+	i.markUnsynced(i.CurrentSegment)
+	return i.commitLocked()
+}
+
+// Abort discards all data written so far, and allows other writes to
+// proceed. No record is published.
+func (w *ObjectWriter) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.ErrClosed
+	}
+	w.closed = true
+	i := w.index
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	defer i.endStreamLocked(w)
+	return i.dm.Rewind(&w.rec)
+}
+
+// discardLocked discards the data written so far after Close failed to
+// publish the object due to err. Callers must hold the index's writeMu.
+func (w *ObjectWriter) discardLocked(err error) error {
+	if rewindErr := w.index.dm.Rewind(&w.rec); rewindErr != nil {
+		return errs.Join(err, rewindErr)
+	}
+	return err
+}
+
+// endStreamLocked releases writes waiting for a given ObjectWriter. Callers
+// must hold writeMu.
+func (i *Index) endStreamLocked(w *ObjectWriter) {
+	i.stream = nil
+	close(w.done)
+}
+
+// Record returns the index record describing the object. Its RecordID is
+// only meaningful after Close returns successfully.
+func (w *ObjectWriter) Record() IndexRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rec
+}
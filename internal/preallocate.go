@@ -0,0 +1,40 @@
+package internal
+
+import (
+	errs "errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/heyvito/wal/errors"
+)
+
+// preallocateFile reserves disk space for a file. It is a variable so tests
+// can simulate a full disk.
+var preallocateFile = preallocate
+
+// reserveFile extends a file to a given size, physically reserving its
+// blocks so that writes through a memory map never fault due to a full disk.
+// Errors caused by a full disk are reported as errors.ErrNoSpace.
+func reserveFile(fd *os.File, size int64) error {
+	err := preallocateFile(fd, size)
+	if errs.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", errors.ErrNoSpace, err)
+	}
+	return err
+}
+
+// writeZeroes extends a file to a given size by writing zeroes to it, which
+// forces the filesystem to allocate its blocks. It is used where a cheaper
+// preallocation mechanism is unavailable.
+func writeZeroes(fd *os.File, size int64) error {
+	zeroes := make([]byte, min(size, 1<<16))
+	for offset := int64(0); offset < size; {
+		n, err := fd.WriteAt(zeroes[:min(size-offset, int64(len(zeroes)))], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return nil
+}
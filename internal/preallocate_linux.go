@@ -0,0 +1,18 @@
+//go:build linux
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for a file through fallocate(2), falling
+// back to writing zeroes on filesystems that do not support it.
+func preallocate(fd *os.File, size int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return writeZeroes(fd, size)
+	}
+	return err
+}
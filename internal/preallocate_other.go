@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "os"
+
+// preallocate reserves size bytes for a file by writing zeroes to it.
+func preallocate(fd *os.File, size int64) error {
+	return writeZeroes(fd, size)
+}
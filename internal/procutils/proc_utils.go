@@ -1,32 +1,17 @@
 package procutils
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
-var procStateReg = regexp.MustCompile(`^\s*(\S+)\s*(\S+)`)
-
-// GetPIDState obtains the `stat` flags from the system process table for a
-// given PID. This is a rather expensive operation, and should be used with
-// caution.
-func GetPIDState(pid int) (ProcessState, error) {
-	stdout := new(bytes.Buffer)
-	cmd := exec.Command("ps", "ax", "-o", "pid,stat")
-	cmd.Stdout = stdout
-	cmd.Stderr = nil
-	cmd.Stdin = nil
-	err := cmd.Run()
-	if err != nil {
-		return 0, fmt.Errorf("failed executing process: %w", err)
-	}
+// ErrNotFound indicates that a given PID does not belong to any process.
+var ErrNotFound = errors.New("process not found")
 
-	return findProcStateFromPSTable(stdout.String(), pid)
-}
+var procStateReg = regexp.MustCompile(`^\s*(\S+)\s*(\S+)`)
 
 func findProcStateFromPSTable(table string, pid int) (ProcessState, error) {
 	data := strings.Split(table, "\n")
@@ -47,22 +32,22 @@ func findProcStateFromPSTable(table string, pid int) (ProcessState, error) {
 			continue
 		}
 
-		var state ProcessState
-		for _, flag := range components[2] {
-			value, ok := stateStringToState[flag]
-			if !ok {
-				continue
-			}
-			if state == 0 {
-				state = value
-			} else {
-				state |= value
-			}
-		}
-		return state, nil
+		return parseState(components[2]), nil
 	}
 
-	return 0, fmt.Errorf("process not found on process table")
+	return 0, fmt.Errorf("%w on process table: %d", ErrNotFound, pid)
+}
+
+// parseState converts state flags, as reported by ps or /proc, into a
+// ProcessState. Unknown flags are ignored.
+func parseState(flags string) ProcessState {
+	var state ProcessState
+	for _, flag := range flags {
+		if value, ok := stateStringToState[flag]; ok {
+			state |= value
+		}
+	}
+	return state
 }
 
 type ProcessState uint32
@@ -0,0 +1,110 @@
+//go:build linux
+
+package procutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks holds the frequency in which /proc reports process times. The
+// kernel reports those in USER_HZ, which is fixed at 100 on every
+// architecture supported by Linux.
+const clockTicks = 100
+
+// procStat holds the fields of /proc/<pid>/stat used by this package.
+type procStat struct {
+	state      ProcessState
+	startTicks uint64
+}
+
+// GetPIDState obtains the state of a given PID from /proc/<pid>/stat.
+// Returns an error wrapping ErrNotFound in case no process exists under pid.
+func GetPIDState(pid int) (ProcessState, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return stat.state, nil
+}
+
+// GetPIDStartTime returns the time a given PID started, as reported by
+// /proc, with a precision of one clock tick. As the kernel reports start
+// times relative to the boot time, which is adjusted along with the system
+// clock, values may drift slightly between calls. Returns an error wrapping
+// ErrNotFound in case no process exists under pid.
+func GetPIDStartTime(pid int) (time.Time, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(stat.sinceBoot()), nil
+}
+
+// sinceBoot returns the time elapsed between the system booting and the
+// process starting. Ticks are scaled without multiplying them by a second
+// first, which would overflow once the system is up for about three years.
+func (s procStat) sinceBoot() time.Duration {
+	return time.Duration(s.startTicks) * (time.Second / clockTicks)
+}
+
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return procStat{}, fmt.Errorf("%w: %d", ErrNotFound, pid)
+	} else if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(data)
+}
+
+// parseProcStat parses the contents of /proc/<pid>/stat. The process' name
+// is enclosed in parentheses and may itself contain spaces and parentheses,
+// so remaining fields are located after the last closing parenthesis.
+func parseProcStat(data []byte) (procStat, error) {
+	end := bytes.LastIndexByte(data, ')')
+	if end == -1 {
+		return procStat{}, fmt.Errorf("malformed process stat")
+	}
+	// The state is the third field of the file, and the start time the
+	// twenty-second.
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return procStat{}, fmt.Errorf("malformed process stat: expected at least 22 fields")
+	}
+	startTicks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procStat{}, fmt.Errorf("malformed process start time: %w", err)
+	}
+	return procStat{state: parseState(fields[0]), startTicks: startTicks}, nil
+}
+
+// bootTime returns the time the system booted, as reported by /proc/stat.
+func bootTime() (time.Time, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "btime ")
+		if !ok {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed boot time: %w", err)
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("boot time not found in /proc/stat")
+}
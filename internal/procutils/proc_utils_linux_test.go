@@ -0,0 +1,29 @@
+package procutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcStat(t *testing.T) {
+	data := "4242 (a) b (c)) Z 1 4242 4242 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 123456 0 0 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 0 0 0 0 0 0\n"
+	stat, err := parseProcStat([]byte(data))
+	require.NoError(t, err)
+	assert.Equal(t, StateDefunct, stat.state)
+	assert.Equal(t, uint64(123456), stat.startTicks)
+	assert.Equal(t, 1234560*time.Millisecond, stat.sinceBoot())
+
+	// Three years of uptime.
+	data = "4242 (a) S 1 4242 4242 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 1 0 9460800000 0 0\n"
+	stat, err = parseProcStat([]byte(data))
+	require.NoError(t, err)
+	assert.Equal(t, 3*365*24*time.Hour, stat.sinceBoot())
+
+	_, err = parseProcStat([]byte("4242 (a) S 1 2"))
+	assert.Error(t, err)
+	_, err = parseProcStat([]byte("4242 a"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+package procutils
+
+import (
+	"bytes"
+	errs "errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetPIDState obtains the `stat` flags from the system process table for a
+// given PID. This is a rather expensive operation, and should be used with
+// caution.
+func GetPIDState(pid int) (ProcessState, error) {
+	stdout := new(bytes.Buffer)
+	cmd := exec.Command("ps", "ax", "-o", "pid,stat")
+	cmd.Stdout = stdout
+	cmd.Stderr = nil
+	cmd.Stdin = nil
+	err := cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("failed executing process: %w", err)
+	}
+
+	return findProcStateFromPSTable(stdout.String(), pid)
+}
+
+// psStartTimeLayout is the layout used by ps to report the lstart column.
+const psStartTimeLayout = "Mon Jan _2 15:04:05 2006"
+
+// GetPIDStartTime returns the time a given PID started, as reported by ps,
+// with a precision of one second. Returns an error wrapping ErrNotFound in
+// case no process exists under pid.
+func GetPIDStartTime(pid int) (time.Time, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	line := strings.TrimSpace(string(out))
+	var exitErr *exec.ExitError
+	if errs.As(err, &exitErr) && line == "" {
+		return time.Time{}, fmt.Errorf("%w: %d", ErrNotFound, pid)
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("failed executing process: %w", err)
+	}
+	return time.ParseInLocation(psStartTimeLayout, line, time.Local)
+}
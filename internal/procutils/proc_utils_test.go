@@ -1,7 +1,9 @@
 package procutils
 
 import (
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,3 +26,19 @@ func TestFindProcStateFromPSTable(t *testing.T) {
 		assert.Equalf(t, expectedState, state, "Expected PID %d to have state %s, found %s instead", pid, expectedState, state)
 	}
 }
+
+func TestGetPIDStartTime(t *testing.T) {
+	started, err := GetPIDStartTime(os.Getpid())
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), started, time.Hour)
+
+	state, err := GetPIDState(os.Getpid())
+	require.NoError(t, err)
+	assert.Zero(t, state&StateDefunct)
+
+	// PIDs are bounded to 2^22 on Linux, and to 99999 on most BSDs.
+	_, err = GetPIDStartTime(1 << 23)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = GetPIDState(1 << 23)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/heyvito/wal/internal/metrics"
+)
+
+// mappedSegment is implemented by segments whose memory mapping is tracked
+// by a segmentCache.
+type mappedSegment interface {
+	// mappedSize returns the amount of bytes mapped for the segment.
+	mappedSize() int64
+
+	// evict unmaps the segment, provided it is sealed and not referenced by
+	// any reader. Returns whether the segment was unmapped.
+	evict() bool
+}
+
+// segmentCache keeps track of mapped segments, unmapping the least recently
+// used sealed segments whenever the amount of mapped bytes or mapped
+// segments exceeds the configured budget. Segments being written to are
+// accounted for, but never evicted. A nil segmentCache tracks nothing.
+type segmentCache struct {
+	maxBytes int64
+	maxOpen  int
+
+	mu    sync.Mutex
+	lru   *list.List
+	elems map[mappedSegment]*list.Element
+	bytes int64
+	open  int
+}
+
+func newSegmentCache(config Config) *segmentCache {
+	return &segmentCache{
+		maxBytes: config.GetMaxMappedBytes(),
+		maxOpen:  config.GetMaxOpenSegments(),
+		lru:      list.New(),
+		elems:    map[mappedSegment]*list.Element{},
+	}
+}
+
+// mapped registers a segment that has just been mapped.
+func (c *segmentCache) mapped(s mappedSegment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.elems[s]; ok {
+		return
+	}
+	c.elems[s] = c.lru.PushFront(s)
+	c.bytes += s.mappedSize()
+	c.open++
+	metrics.Simple(metrics.CommonSegmentMaps, 0)
+	metrics.Simple(metrics.CommonMappedBytes, float64(c.bytes))
+}
+
+// unmapped unregisters a segment that has just been unmapped.
+func (c *segmentCache) unmapped(s mappedSegment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.elems[s]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.elems, s)
+	c.bytes -= s.mappedSize()
+	c.open--
+	metrics.Simple(metrics.CommonSegmentUnmaps, 0)
+	metrics.Simple(metrics.CommonMappedBytes, float64(c.bytes))
+}
+
+// touch marks a segment as recently used.
+func (c *segmentCache) touch(s mappedSegment) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elems[s]; ok {
+		c.lru.MoveToFront(e)
+	}
+}
+
+func (c *segmentCache) overBudgetLocked() bool {
+	return (c.maxBytes > 0 && c.bytes > c.maxBytes) ||
+		(c.maxOpen > 0 && c.open > c.maxOpen)
+}
+
+// enforce evicts least recently used segments until the cache fits its
+// budget, or no further segment can be evicted. Callers must not hold the
+// mapping lock of any segment.
+func (c *segmentCache) enforce() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Back(); e != nil && c.overBudgetLocked(); {
+		s := e.Value.(mappedSegment)
+		prev := e.Prev()
+		c.mu.Unlock()
+		s.evict()
+		c.mu.Lock()
+		e = prev
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-stdlog/stdlog"
+)
+
+const (
+	indexSegmentPrefix = "index"
+	dataSegmentPrefix  = "data"
+)
+
+// listSegments returns the sorted ids of segments whose files are named
+// after a given prefix in store. Files sharing the prefix without being
+// followed by a segment id are reported and ignored.
+func listSegments(store SegmentStore, prefix string, log stdlog.Logger) ([]int64, error) {
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id, ok := parseSegmentID(name[len(prefix):])
+		if !ok {
+			log.Warning("Ignoring unrelated file in working directory", "name", name)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// parseSegmentID parses the numeric suffix of a segment file name.
+func parseSegmentID(s string) (int64, bool) {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil
+}
+
+// isSegmentFile returns whether name is the file name of a segment with a
+// given prefix.
+func isSegmentFile(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, ok := parseSegmentID(name[len(prefix):])
+	return ok
+}
+
+// loadSegments calls load for each id concurrently, returning the loaded
+// segments in the same order as ids, or the first error encountered. In case
+// of failure, segments loaded successfully are closed before returning.
+func loadSegments[T interface{ Close() error }](ids []int64, load func(id int64) (T, error)) ([]T, error) {
+	segments := make([]T, len(ids))
+	loaded := make([]bool, len(ids))
+	workers := min(len(ids), 4*runtime.GOMAXPROCS(0))
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		err     error
+		next    = make(chan int)
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				seg, loadErr := load(ids[n])
+				if loadErr != nil {
+					errOnce.Do(func() { err = loadErr })
+					continue
+				}
+				segments[n], loaded[n] = seg, true
+			}
+		}()
+	}
+	for n := range ids {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+
+	if err != nil {
+		for n, seg := range segments {
+			if loaded[n] {
+				_ = seg.Close()
+			}
+		}
+		return nil, err
+	}
+	return segments, nil
+}
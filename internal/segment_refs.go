@@ -0,0 +1,79 @@
+package internal
+
+import (
+	errs "errors"
+	"sync/atomic"
+
+	"github.com/heyvito/wal/internal/metrics"
+)
+
+// segmentRefs counts references to a memory-mapped segment. Segments start
+// with a single reference held by their owner, released when the segment is
+// closed or unlinked. Readers acquire further references while accessing the
+// segment's memory, so that it is only unmapped once every reference has
+// been released.
+type segmentRefs struct {
+	count  atomic.Int64
+	owned  atomic.Bool
+	unlink atomic.Bool
+}
+
+func (r *segmentRefs) init() {
+	r.count.Store(1)
+	r.owned.Store(true)
+}
+
+// acquire obtains a new reference, unless the segment has already been
+// released by all of its holders.
+func (r *segmentRefs) acquire() bool {
+	for {
+		n := r.count.Load()
+		if n <= 0 {
+			return false
+		}
+		if r.count.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference, returning whether it was the last one.
+func (r *segmentRefs) release() bool {
+	return r.count.Add(-1) == 0
+}
+
+// releaseOwner drops the owner's reference, returning whether it was the
+// last one. Further calls have no effect.
+func (r *segmentRefs) releaseOwner() bool {
+	if !r.owned.CompareAndSwap(true, false) {
+		return false
+	}
+	return r.release()
+}
+
+// markUnlinked flags the segment as removed from disk while possibly still
+// referenced by readers.
+func (r *segmentRefs) markUnlinked() {
+	if !r.unlink.Swap(true) {
+		metrics.Simple(metrics.CommonSegmentsPendingDeletion, float64(segmentsPendingDeletion.Add(1)))
+	}
+}
+
+// finishUnlink accounts for the release of the last reference to a segment
+// flagged through markUnlinked. Returns whether the segment was flagged.
+func (r *segmentRefs) finishUnlink() bool {
+	if !r.unlink.Load() {
+		return false
+	}
+	metrics.Simple(metrics.CommonSegmentsPendingDeletion, float64(segmentsPendingDeletion.Add(-1)))
+	return true
+}
+
+// segmentsPendingDeletion holds the amount of segments unlinked while still
+// referenced, across all instances in the process. Their files are already
+// removed, but the space they take is only reclaimed once unmapped.
+var segmentsPendingDeletion atomic.Int64
+
+// errSegmentReleased is returned when acquiring a segment that has already
+// been released by all of its holders.
+var errSegmentReleased = errs.New("segment has been released")
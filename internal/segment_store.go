@@ -0,0 +1,68 @@
+package internal
+
+// SegmentStore provides storage for the files backing index and data
+// segments, along with the manifest. Files are identified by name.
+type SegmentStore interface {
+	// List returns the names of all files held by the store.
+	List() ([]string, error)
+
+	// Size returns the size of a given file.
+	Size(name string) (int64, error)
+
+	// Create creates a zero-filled file with a given size, reserving the
+	// space it requires. Returns an error satisfying errors.Is(err,
+	// fs.ErrExist) in case the file already exists, and one wrapping
+	// errors.ErrNoSpace in case its space cannot be reserved.
+	Create(name string, size int64) error
+
+	// ReadAt reads len(b) bytes from a given file, starting at offset,
+	// without opening it for writing.
+	ReadAt(name string, b []byte, offset int64) error
+
+	// Open opens an existing file for reading and writing.
+	Open(name string) (SegmentFile, error)
+
+	// OpenReadOnly opens an existing file for reading only. Changes made to
+	// the file by other processes must remain visible through the returned
+	// file, so that a read-only WAL can follow a writer. Stores unable to do
+	// so return an error wrapping errors.ErrUnsupported.
+	OpenReadOnly(name string) (SegmentFile, error)
+
+	// SharesChanges returns whether changes made to a file by other
+	// processes are visible through files already opened by this store.
+	SharesChanges() bool
+
+	// Remove removes a given file. Files already opened remain usable until
+	// closed.
+	Remove(name string) error
+
+	// ReadFile returns the contents of a given file.
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile atomically replaces the contents of a given file, creating it
+	// when it does not exist.
+	WriteFile(name string, data []byte) error
+
+	// Sync makes the creation and removal of files durable.
+	Sync() error
+}
+
+// SegmentFile is a file opened through a SegmentStore. Its contents are
+// accessed directly through the slice returned by Bytes.
+type SegmentFile interface {
+	// Bytes returns the contents of the file. Changes made to the returned
+	// slice reach the file once passed to Flush.
+	Bytes() []byte
+
+	// Flush writes a region of Bytes changed by the caller to the file, so
+	// that it survives a crash of the process. Errors are reported by the
+	// next call to Sync or Close.
+	Flush(offset, size int64)
+
+	// Sync flushes a region of the file to stable storage.
+	Sync(offset, size int64) error
+
+	// Close releases resources held by the file. The slice returned by Bytes
+	// must not be used afterwards.
+	Close() error
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentStores(t *testing.T) {
+	stores := map[string]func(dir string) SegmentStore{
+		"mmap":   func(dir string) SegmentStore { return NewMMapStore(dir) },
+		"file":   func(dir string) SegmentStore { return NewFileStore(dir) },
+		"memory": func(string) SegmentStore { return NewMemoryStore() },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := newStore(dir)
+
+			require.NoError(t, store.Create("seg", 16))
+			assert.ErrorIs(t, store.Create("seg", 16), fs.ErrExist)
+			size, err := store.Size("seg")
+			require.NoError(t, err)
+			assert.Equal(t, int64(16), size)
+
+			f, err := store.Open("seg")
+			require.NoError(t, err)
+			copy(f.Bytes()[4:], "data")
+			f.Flush(4, 4)
+			require.NoError(t, f.Sync(4, 4))
+
+			// Flushed changes are visible before the file is closed.
+			b := make([]byte, 4)
+			require.NoError(t, store.ReadAt("seg", b, 4))
+			assert.Equal(t, "data", string(b))
+			if name != "memory" {
+				onDisk, err := os.ReadFile(filepath.Join(dir, "seg"))
+				require.NoError(t, err)
+				assert.Equal(t, "data", string(onDisk[4:8]))
+			}
+			require.NoError(t, f.Close())
+			assert.Equal(t, name != "file", store.SharesChanges())
+
+			require.NoError(t, store.WriteFile("manifest", []byte("contents")))
+			contents, err := store.ReadFile("manifest")
+			require.NoError(t, err)
+			assert.Equal(t, "contents", string(contents))
+
+			names, err := store.List()
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"seg", "manifest"}, names)
+
+			require.NoError(t, store.Remove("seg"))
+			_, err = store.Open("seg")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			require.NoError(t, store.Sync())
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"slices"
+	"sort"
+)
+
+// segmentTableEntry holds an index segment along with the id of the first
+// record it may contain.
+type segmentTableEntry struct {
+	first   int64
+	segment *IndexSegment
+}
+
+// segmentTable is an immutable view of index segments, sorted by the ids of
+// the records they hold. Tables are rebuilt and swapped whenever segments
+// are created or removed, allowing lookups to be performed without locks.
+type segmentTable struct {
+	entries []segmentTableEntry
+
+	// countAfter holds, for each entry, the amount of records held by the
+	// sealed segments following it. The last segment still receives records,
+	// so its count is not accounted for.
+	countAfter []int64
+}
+
+func newSegmentTable(segments *AtomicMap[int64, *IndexSegment]) *segmentTable {
+	t := &segmentTable{}
+	for _, seg := range segments.Range() {
+		first := seg.LowerRecord.Load()
+		if seg.Cursor.Load() > 0 {
+			first = seg.FirstRecordID
+		}
+		t.entries = append(t.entries, segmentTableEntry{first: first, segment: seg})
+	}
+	slices.SortFunc(t.entries, func(a, b segmentTableEntry) int {
+		return int(a.segment.SegmentID - b.segment.SegmentID)
+	})
+
+	t.countAfter = make([]int64, len(t.entries))
+	for n := len(t.entries) - 3; n >= 0; n-- {
+		t.countAfter[n] = t.countAfter[n+1] + t.entries[n+1].segment.RecordsCount.Load()
+	}
+	return t
+}
+
+// find returns the position of the segment containing a given record id.
+func (t *segmentTable) find(id int64) (int, bool) {
+	n := sort.Search(len(t.entries), func(n int) bool {
+		return t.entries[n].first > id
+	}) - 1
+	if n < 0 || !t.entries[n].segment.ContainsRecord(id) {
+		return 0, false
+	}
+	return n, true
+}
+
+// countFrom returns the amount of records held by segments following the
+// one at position n.
+func (t *segmentTable) countFrom(n int) int64 {
+	total := t.countAfter[n]
+	if last := len(t.entries) - 1; n < last {
+		total += t.entries[last].segment.RecordsCount.Load()
+	}
+	return total
+}
+
+// publishSegments rebuilds the segment table from the current set of
+// segments. Callers must hold writeMu, or have exclusive access to the
+// index.
+func (i *Index) publishSegments() {
+	i.table.Store(newSegmentTable(&i.Segments))
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentTable(t *testing.T) {
+	conf := NewDummyConfig(t)
+	idx, err := NewIndex(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, idx.Close()) }()
+
+	for range 20 {
+		require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	}
+	require.NoError(t, idx.VacuumObjects(4, true))
+
+	for id := int64(-1); id <= 21; id++ {
+		seg, ok := idx.SegmentForID(id)
+		if id < 5 || id > 19 {
+			assert.Falsef(t, ok, "expected record %d not to be found", id)
+			continue
+		}
+		require.Truef(t, ok, "expected record %d to be found", id)
+		assert.Equal(t, id/3, seg.SegmentID)
+		assert.Equal(t, 19-id, idx.CountObjects(id, false))
+		assert.Equal(t, 20-id, idx.CountObjects(id, true))
+	}
+
+	require.NoError(t, idx.Append(randomData(t, 8), &IndexRecord{}))
+	assert.Equal(t, int64(16), idx.CountObjects(5, true))
+	seg, ok := idx.SegmentForID(20)
+	require.True(t, ok)
+	assert.Equal(t, int64(6), seg.SegmentID)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import "github.com/heyvito/wal/errors"
+
+// snapshotSegment records the range of records an index segment held when a
+// snapshot was taken.
+type snapshotSegment struct {
+	segment *IndexSegment
+	first   int64
+	last    int64
+}
+
+// snapshot pins the records available in the index at the time it was
+// taken. The snapshot holds a reference to each index segment it covers, so
+// segments unlinked by vacuum are only removed once it is released. Data
+// segments holding data for records within its bounds are kept by vacuum
+// while it is held.
+type snapshot struct {
+	lower    int64
+	upper    int64
+	segments []snapshotSegment
+
+	// vacuumed indicates whether a vacuum took place while the snapshot was
+	// held, in which case data segments it pinned may be removed once it is
+	// released.
+	vacuumed bool
+}
+
+// lookup loads the record under id, regardless of it having been purged
+// after the snapshot was taken.
+func (s *snapshot) lookup(id int64, rec *IndexRecord) error {
+	if id < s.lower || id > s.upper {
+		return errors.NotFound{RecordID: id}
+	}
+	for _, seg := range s.segments {
+		if id < seg.first || id > seg.last {
+			continue
+		}
+		offset := (id - seg.first) * seg.segment.RecordSize
+		seg.segment.readRecord(seg.segment.Records[offset:], rec)
+		rec.Purged = false
+		return nil
+	}
+	return errors.NotFound{RecordID: id}
+}
+
+// takeSnapshot pins the records currently available in the index.
+func (i *Index) takeSnapshot() *snapshot {
+	i.snapshotsMu.Lock()
+	defer i.snapshotsMu.Unlock()
+
+	s := &snapshot{
+		lower: i.MinimumRecordID(),
+		upper: i.MaxRecord.Load(),
+	}
+	for _, seg := range i.Segments.Range() {
+		count := seg.Cursor.Load() / seg.RecordSize
+		if count == 0 {
+			continue
+		}
+		first, last := seg.FirstRecordID, seg.FirstRecordID+count-1
+		if last < s.lower || first > s.upper {
+			continue
+		}
+		if err := seg.Acquire(); err != nil {
+			if err != errSegmentReleased {
+				i.log.Error(err, "Failed mapping segment for snapshot", "segment_id", seg.SegmentID)
+			}
+			continue
+		}
+		s.segments = append(s.segments, snapshotSegment{segment: seg, first: first, last: last})
+	}
+
+	if i.snapshots == nil {
+		i.snapshots = map[*snapshot]struct{}{}
+	}
+	i.snapshots[s] = struct{}{}
+	return s
+}
+
+// releaseSnapshot unpins a snapshot, releasing its references to index
+// segments, and removing data segments it kept from being vacuumed.
+func (i *Index) releaseSnapshot(s *snapshot) error {
+	var err error
+	for _, seg := range s.segments {
+		if releaseErr := seg.segment.Release(); releaseErr != nil {
+			i.log.Error(releaseErr, "Failed releasing segment", "segment_id", seg.segment.SegmentID)
+			err = releaseErr
+		}
+	}
+
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	i.snapshotsMu.Lock()
+	defer i.snapshotsMu.Unlock()
+
+	delete(i.snapshots, s)
+	if err != nil || !s.vacuumed || i.closed.Load() {
+		return err
+	}
+	return i.vacuumDataLocked()
+}
+
+// pinnedDataSegmentsLocked returns the ids of data segments holding data for
+// records pinned by snapshots. As data is written sequentially, those are
+// the segments between the ones holding the first and last pinned records.
+// Callers must hold snapshotsMu.
+func (i *Index) pinnedDataSegmentsLocked() []int64 {
+	var ids []int64
+	first, last := &IndexRecord{}, &IndexRecord{}
+	for s := range i.snapshots {
+		if s.lookup(s.lower, first) != nil || s.lookup(s.upper, last) != nil {
+			continue
+		}
+		for segID := first.DataSegmentStartID; segID <= last.DataSegmentEndID; segID++ {
+			ids = append(ids, segID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,266 @@
+package internal
+
+import (
+	errs "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/heyvito/gommap"
+
+	"github.com/heyvito/wal/errors"
+)
+
+// dirStore implements the operations shared by stores keeping files in a
+// directory.
+type dirStore struct {
+	dir string
+}
+
+func (d dirStore) path(name string) string { return filepath.Join(d.dir, name) }
+
+func (d dirStore) List() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d dirStore) Size(name string) (int64, error) {
+	stat, err := os.Stat(d.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// Create creates a file with its blocks reserved on disk. Returns an error
+// wrapping errors.ErrNoSpace in case the disk is full, in which case no file
+// is left behind.
+func (d dirStore) Create(name string, size int64) error {
+	fd, err := os.OpenFile(d.path(name), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644)
+	if errs.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", errors.ErrNoSpace, err)
+	} else if err != nil {
+		return err
+	}
+	err = reserveFile(fd, size)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(d.path(name))
+	}
+	return err
+}
+
+func (d dirStore) ReadAt(name string, b []byte, offset int64) error {
+	fd, err := os.Open(d.path(name))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = fd.Close() }()
+	_, err = fd.ReadAt(b, offset)
+	return err
+}
+
+func (d dirStore) Remove(name string) error {
+	return os.Remove(d.path(name))
+}
+
+func (d dirStore) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(d.path(name))
+}
+
+func (d dirStore) WriteFile(name string, data []byte) error {
+	tmp := d.path(name + ".tmp")
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, d.path(name)); err != nil {
+		return err
+	}
+	return d.Sync()
+}
+
+func (d dirStore) Sync() error {
+	return syncDir(d.dir)
+}
+
+// MMapStore keeps files in a directory, accessing their contents through
+// shared memory maps. Writes reach the file as soon as they are made.
+type MMapStore struct {
+	dirStore
+}
+
+// NewMMapStore returns a MMapStore keeping files in dir.
+func NewMMapStore(dir string) *MMapStore {
+	return &MMapStore{dirStore{dir: dir}}
+}
+
+func (s *MMapStore) Open(name string) (SegmentFile, error) {
+	fd, err := os.OpenFile(s.path(name), os.O_RDWR|os.O_EXCL|os.O_SYNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := gommap.Map(fd.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &mmapFile{fd: fd, data: mapped}, nil
+}
+
+// SharesChanges returns true, as files are mapped shared.
+func (s *MMapStore) SharesChanges() bool { return true }
+
+// OpenReadOnly maps a file for reading only. As the mapping is shared with
+// the file, changes made by other processes are immediately visible.
+func (s *MMapStore) OpenReadOnly(name string) (SegmentFile, error) {
+	fd, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := gommap.Map(fd.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &mmapFile{fd: fd, data: mapped, readOnly: true}, nil
+}
+
+type mmapFile struct {
+	fd       *os.File
+	data     gommap.MMap
+	readOnly bool
+}
+
+func (f *mmapFile) Bytes() []byte { return f.data }
+
+func (f *mmapFile) Flush(int64, int64) {}
+
+func (f *mmapFile) Sync(offset, size int64) error {
+	if f.readOnly {
+		return nil
+	}
+	return syncRange(f.data, offset, size)
+}
+
+func (f *mmapFile) Close() error {
+	if err := f.data.UnsafeUnmap(); err != nil {
+		return err
+	}
+	return f.fd.Close()
+}
+
+// FileStore keeps files in a directory, reading their contents into memory
+// when opened, and writing changes back through regular file I/O. It suits
+// filesystems on which memory maps are unsupported or perform poorly. As
+// changes made by other processes are not observed, writers using it read the
+// WAL's epoch from disk before every write, in order to be fenced out by
+// epochs started by other writers. This costs opening, reading and closing
+// the epoch file on each write.
+type FileStore struct {
+	dirStore
+}
+
+// NewFileStore returns a FileStore keeping files in dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dirStore{dir: dir}}
+}
+
+func (s *FileStore) Open(name string) (SegmentFile, error) {
+	fd, err := os.OpenFile(s.path(name), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	data := make([]byte, stat.Size())
+	if _, err = fd.ReadAt(data, 0); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return &ioFile{fd: fd, data: data}, nil
+}
+
+// SharesChanges returns false, as files are read into memory when opened.
+func (s *FileStore) SharesChanges() bool { return false }
+
+// OpenReadOnly is not supported, as files are read into memory when opened,
+// and changes made by other processes afterwards would not be visible.
+func (s *FileStore) OpenReadOnly(name string) (SegmentFile, error) {
+	return nil, fmt.Errorf("file store cannot open %s for reading only: %w", name, errs.ErrUnsupported)
+}
+
+type ioFile struct {
+	fd   *os.File
+	data []byte
+
+	mu  sync.Mutex
+	err error
+}
+
+func (f *ioFile) Bytes() []byte { return f.data }
+
+func (f *ioFile) Flush(offset, size int64) {
+	if size <= 0 {
+		return
+	}
+	if _, err := f.fd.WriteAt(f.data[offset:offset+size], offset); err != nil {
+		f.mu.Lock()
+		if f.err == nil {
+			f.err = err
+		}
+		f.mu.Unlock()
+	}
+}
+
+// writeErr returns the first error encountered by Flush, if any.
+func (f *ioFile) writeErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *ioFile) Sync(offset, size int64) error {
+	if err := f.writeErr(); err != nil {
+		return err
+	}
+	if size <= 0 {
+		return nil
+	}
+	return f.fd.Sync()
+}
+
+func (f *ioFile) Close() error {
+	err := f.writeErr()
+	if closeErr := f.fd.Close(); err == nil {
+		err = closeErr
+	}
+	f.data = nil
+	return err
+}
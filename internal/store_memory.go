@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"sync"
+)
+
+// MemoryStore keeps files in memory. Its contents are lost once the process
+// exits, but survive the WAL being closed and opened again with the same
+// store.
+type MemoryStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{files: map[string][]byte{}}
+}
+
+func (s *MemoryStore) load(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (s *MemoryStore) Size(name string) (int64, error) {
+	data, err := s.load(name)
+	return int64(len(data)), err
+}
+
+func (s *MemoryStore) Create(name string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; ok {
+		return &os.PathError{Op: "create", Path: name, Err: os.ErrExist}
+	}
+	s.files[name] = make([]byte, size)
+	return nil
+}
+
+func (s *MemoryStore) ReadAt(name string, b []byte, offset int64) error {
+	data, err := s.load(name)
+	if err != nil {
+		return err
+	}
+	if offset+int64(len(b)) > int64(len(data)) {
+		return &os.PathError{Op: "read", Path: name, Err: os.ErrInvalid}
+	}
+	copy(b, data[offset:])
+	return nil
+}
+
+func (s *MemoryStore) Open(name string) (SegmentFile, error) {
+	data, err := s.load(name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryFile(data), nil
+}
+
+// SharesChanges returns true, as files are shared by every user of the
+// store.
+func (s *MemoryStore) SharesChanges() bool { return true }
+
+// OpenReadOnly opens a file for reading only. Files are shared by every
+// user of the store, so changes made through other handles are visible.
+func (s *MemoryStore) OpenReadOnly(name string) (SegmentFile, error) {
+	return s.Open(name)
+}
+
+func (s *MemoryStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemoryStore) ReadFile(name string) ([]byte, error) {
+	data, err := s.load(name)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(data), nil
+}
+
+func (s *MemoryStore) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = slices.Clone(data)
+	return nil
+}
+
+func (s *MemoryStore) Sync() error { return nil }
+
+type memoryFile []byte
+
+func (f memoryFile) Bytes() []byte           { return f }
+func (f memoryFile) Flush(int64, int64)      {}
+func (f memoryFile) Sync(int64, int64) error { return nil }
+func (f memoryFile) Close() error            { return nil }
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"os"
+	"time"
+
+	"github.com/heyvito/gommap"
+)
+
+type SyncMode int
+
+const (
+	// SyncModeNone leaves flushing of written data to the operating system.
+	SyncModeNone SyncMode = iota
+
+	// SyncModeEveryWrite flushes all ranges touched by a write before the
+	// write is acknowledged.
+	SyncModeEveryWrite
+
+	// SyncModeInterval flushes all pending writes periodically, from a
+	// background goroutine.
+	SyncModeInterval
+)
+
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+}
+
+var pageSize = int64(os.Getpagesize())
+
+// syncRange synchronously flushes a region of a given memory map to its
+// backing file. The region's start is aligned down to the system's page size,
+// as required by msync(2).
+func syncRange(m gommap.MMap, offset, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	start := offset - offset%pageSize
+	return m[start : offset+size].Sync(gommap.MS_SYNC)
+}
+
+// dirtyRange tracks the lowest and highest offsets modified in a region since
+// it was last flushed.
+type dirtyRange struct {
+	lo, hi int64
+}
+
+func (d *dirtyRange) mark(offset, size int64) {
+	if size <= 0 {
+		return
+	}
+	if d.hi == d.lo {
+		d.lo, d.hi = offset, offset+size
+		return
+	}
+	d.lo = min(d.lo, offset)
+	d.hi = max(d.hi, offset+size)
+}
+
+func (d *dirtyRange) take() (offset, size int64) {
+	offset, size = d.lo, d.hi-d.lo
+	d.lo, d.hi = 0, 0
+	return
+}
+
+// syncDir flushes a directory's entries to stable storage, making file
+// creations and removals within it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
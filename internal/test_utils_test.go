@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-stdlog/stdlog"
 	"github.com/stretchr/testify/require"
@@ -25,6 +27,14 @@ type DummyConfig struct {
 	DataSegmentSize  int64
 	WorkDir          string
 	Logger           stdlog.Logger
+	SyncPolicy       SyncPolicy
+	MaxBatch         int
+	MaxLinger        time.Duration
+	FirstRecordID    int64
+	MaxMappedBytes   int64
+	MaxOpenSegments  int
+	Store            SegmentStore
+	ReadOnly         bool
 }
 
 func (d DummyConfig) GetIndexSegmentSize() int64 {
@@ -43,6 +53,41 @@ func (d DummyConfig) GetLogger() stdlog.Logger {
 	return d.Logger
 }
 
+func (d DummyConfig) GetSyncPolicy() SyncPolicy {
+	return d.SyncPolicy
+}
+
+func (d DummyConfig) GetGroupCommitMaxBatch() int {
+	return d.MaxBatch
+}
+
+func (d DummyConfig) GetGroupCommitMaxLinger() time.Duration {
+	return d.MaxLinger
+}
+
+func (d DummyConfig) GetFirstRecordID() int64 {
+	return d.FirstRecordID
+}
+
+func (d DummyConfig) GetMaxMappedBytes() int64 {
+	return d.MaxMappedBytes
+}
+
+func (d DummyConfig) GetMaxOpenSegments() int {
+	return d.MaxOpenSegments
+}
+
+func (d DummyConfig) GetReadOnly() bool {
+	return d.ReadOnly
+}
+
+func (d DummyConfig) GetStore() SegmentStore {
+	if d.Store != nil {
+		return d.Store
+	}
+	return NewMMapStore(d.WorkDir)
+}
+
 func WithLogger() DummyOpt {
 	return func(d *DummyConfig) { d.Logger = stdlog.NewStd(os.Stdout) }
 }
@@ -55,6 +100,30 @@ func WithDataSegmentSize(size int64) DummyOpt {
 	return func(d *DummyConfig) { d.DataSegmentSize = size }
 }
 
+func WithSyncPolicy(policy SyncPolicy) DummyOpt {
+	return func(d *DummyConfig) { d.SyncPolicy = policy }
+}
+
+func WithFirstRecordID(id int64) DummyOpt {
+	return func(d *DummyConfig) { d.FirstRecordID = id }
+}
+
+func WithMappingBudget(maxBytes int64, maxOpen int) DummyOpt {
+	return func(d *DummyConfig) { d.MaxMappedBytes, d.MaxOpenSegments = maxBytes, maxOpen }
+}
+
+func WithStore(store SegmentStore) DummyOpt {
+	return func(d *DummyConfig) { d.Store = store }
+}
+
+func WithReadOnly() DummyOpt {
+	return func(d *DummyConfig) { d.ReadOnly = true }
+}
+
+func WithGroupCommit(maxBatch int, maxLinger time.Duration) DummyOpt {
+	return func(d *DummyConfig) { d.MaxBatch, d.MaxLinger = maxBatch, maxLinger }
+}
+
 type DummyOpt func(*DummyConfig)
 
 func NewDummyConfig(t *testing.T, dummyOpts ...DummyOpt) *DummyConfig {
@@ -82,3 +151,43 @@ func randomData(t *testing.T, size int64) []byte {
 	require.Equal(t, int64(n), size)
 	return data
 }
+
+// openTrackingStore counts the files opened through it that were not closed
+// yet.
+type openTrackingStore struct {
+	SegmentStore
+	open atomic.Int32
+}
+
+func (s *openTrackingStore) Open(name string) (SegmentFile, error) {
+	f, err := s.SegmentStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s.open.Add(1)
+	return &openTrackingFile{SegmentFile: f, store: s}, nil
+}
+
+type openTrackingFile struct {
+	SegmentFile
+	store *openTrackingStore
+}
+
+func (f *openTrackingFile) Close() error {
+	f.store.open.Add(-1)
+	return f.SegmentFile.Close()
+}
+
+// failingStore fails opening a given file, as a store unable to map it would.
+type failingStore struct {
+	SegmentStore
+	name string
+	err  error
+}
+
+func (s failingStore) Open(name string) (SegmentFile, error) {
+	if name == s.name {
+		return nil, s.err
+	}
+	return s.SegmentStore.Open(name)
+}
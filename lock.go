@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	errs "errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/heyvito/wal/internal/flock"
+	"github.com/heyvito/wal/internal/procutils"
+)
+
+// lockFileName is the name of the file within WorkDir holding the WAL's
+// lock.
+const lockFileName = "lock"
+
+// maxLockFileSize bounds the amount of data read from lock files.
+const maxLockFileSize = 4096
+
+// Bounds of the delay between attempts to obtain a lock held by another
+// process, which doubles after each attempt.
+const (
+	lockRetryMinBackoff = 10 * time.Millisecond
+	lockRetryMaxBackoff = time.Second
+)
+
+// LockInfo describes the process holding a WAL's lock, as recorded in its
+// lock file by the process that obtained it. Lock files written by older
+// versions only record the holder's PID.
+type LockInfo struct {
+	// PID represents the id of the process holding the lock.
+	PID int `json:"pid"`
+
+	// Hostname represents the name of the host the process runs on.
+	Hostname string `json:"hostname,omitempty"`
+
+	// Executable represents the path to the process' executable.
+	Executable string `json:"executable,omitempty"`
+
+	// StartTime represents the time the process started.
+	StartTime time.Time `json:"start_time,omitempty"`
+
+	// AcquiredAt represents the time the lock was obtained.
+	AcquiredAt time.Time `json:"acquired_at,omitempty"`
+
+	// Held indicates whether the lock is currently held. Lock files are left
+	// behind by processes that do not shut down cleanly, in which case they
+	// describe a process that no longer holds the lock.
+	Held bool `json:"-"`
+}
+
+// Age returns how long the lock has been held for, or zero in case the time
+// it was obtained is unknown.
+func (l LockInfo) Age() time.Duration {
+	if l.AcquiredAt.IsZero() {
+		return 0
+	}
+	return time.Since(l.AcquiredAt)
+}
+
+// InspectLock reports the process holding the lock of the WAL kept in
+// workdir, without opening the WAL. Returns an error satisfying
+// errors.Is(err, fs.ErrNotExist) in case no lock file exists, which is the
+// case for WALs that are not open, or have been closed cleanly.
+func InspectLock(workdir string) (LockInfo, error) {
+	f, err := flock.Open(filepath.Join(workdir, lockFileName))
+	if err != nil {
+		return LockInfo{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := readLockInfo(f)
+	if err != nil {
+		return LockInfo{}, err
+	}
+	err = f.LockShared()
+	info.Held = errs.Is(err, flock.CannotLockErr)
+	if err != nil && !info.Held {
+		return LockInfo{}, err
+	}
+	return info, nil
+}
+
+// readLockInfo reads the contents of a lock file. Empty or unrecognised
+// files yield an empty LockInfo.
+func readLockInfo(f flock.Flock) (LockInfo, error) {
+	data := make([]byte, maxLockFileSize)
+	l, err := f.Read(data)
+	if err != nil && err != io.EOF {
+		return LockInfo{}, err
+	}
+	info, _ := parseLockInfo(data[:l])
+	return info, nil
+}
+
+// parseLockInfo decodes the contents of a lock file, either as the JSON
+// document written by writeLockInfo, or as the big-endian PID written by
+// older versions. Returns false in case data is in neither format.
+func parseLockInfo(data []byte) (LockInfo, bool) {
+	var info LockInfo
+	switch {
+	case bytes.HasPrefix(data, []byte("{")):
+		if err := json.Unmarshal(data, &info); err != nil {
+			return LockInfo{}, false
+		}
+		return info, true
+	case len(data) >= 8:
+		info.PID = int(binary.BigEndian.Uint64(data))
+		return info, true
+	default:
+		return LockInfo{}, false
+	}
+}
+
+// currentLockInfo describes the current process, for recording in the lock
+// file. Fields that cannot be determined are left empty.
+func currentLockInfo() LockInfo {
+	info := LockInfo{PID: os.Getpid(), AcquiredAt: time.Now()}
+	info.Hostname, _ = os.Hostname()
+	info.Executable, _ = os.Executable()
+	info.StartTime, _ = procutils.GetPIDStartTime(info.PID)
+	return info
+}
+
+// startTimeTolerance bounds the difference between start times considered to
+// belong to the same process, as those may drift along with the system clock.
+const startTimeTolerance = time.Second
+
+// sameStartTime returns whether two start times belong to the same process.
+func sameStartTime(a, b time.Time) bool {
+	return a.Sub(b).Abs() <= startTimeTolerance
+}
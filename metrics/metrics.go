@@ -29,6 +29,18 @@ func (d *Delegates) Dispatch(kind metrics.MetricKind, value float64) {
 		d.Main.WriteObjectLatency(value)
 	case metrics.CommonWriteObjectFailures:
 		d.Main.WriteObjectFailures(value)
+	case metrics.CommonWriteBatchCalls:
+		if del, ok := d.Main.(WriteBatchInstrumentationDelegate); ok {
+			del.WriteBatchCalls(value)
+		}
+	case metrics.CommonWriteBatchLatency:
+		if del, ok := d.Main.(WriteBatchInstrumentationDelegate); ok {
+			del.WriteBatchLatency(value)
+		}
+	case metrics.CommonWriteBatchFailures:
+		if del, ok := d.Main.(WriteBatchInstrumentationDelegate); ok {
+			del.WriteBatchFailures(value)
+		}
 	case metrics.CommonReadObjectCalls:
 		d.Main.ReadObjectCalls(value)
 	case metrics.CommonReadObjectLatency:
@@ -63,16 +75,56 @@ func (d *Delegates) Dispatch(kind metrics.MetricKind, value float64) {
 		d.Main.DataSegmentsCount(value)
 	case metrics.CommonRecordsCount:
 		d.Main.RecordsCount(value)
+	case metrics.CommonSegmentsPendingDeletion:
+		if del, ok := d.Main.(SegmentMappingInstrumentationDelegate); ok {
+			del.SegmentsPendingDeletion(value)
+		}
+	case metrics.CommonSegmentMaps:
+		if del, ok := d.Main.(SegmentMappingInstrumentationDelegate); ok {
+			del.SegmentMaps(value)
+		}
+	case metrics.CommonSegmentUnmaps:
+		if del, ok := d.Main.(SegmentMappingInstrumentationDelegate); ok {
+			del.SegmentUnmaps(value)
+		}
+	case metrics.CommonMappedBytes:
+		if del, ok := d.Main.(SegmentMappingInstrumentationDelegate); ok {
+			del.MappedBytes(value)
+		}
 	case metrics.IndexAppendLatency:
 		d.Index.AppendLatency(value)
 	case metrics.IndexAppendCalls:
 		d.Index.AppendCalls(value)
+	case metrics.IndexAppendBatchLatency:
+		if del, ok := d.Index.(IndexAppendBatchInstrumentationDelegate); ok {
+			del.AppendBatchLatency(value)
+		}
+	case metrics.IndexAppendBatchCalls:
+		if del, ok := d.Index.(IndexAppendBatchInstrumentationDelegate); ok {
+			del.AppendBatchCalls(value)
+		}
 	case metrics.IndexLookupLatency:
 		d.Index.LookupLatency(value)
 	case metrics.IndexCountObjectsLatency:
 		d.Index.CountObjectsLatency(value)
 	case metrics.IndexVacuumObjectsLatency:
 		d.Index.VacuumObjectsLatency(value)
+	case metrics.IndexTruncateAfterLatency:
+		if del, ok := d.Index.(IndexTruncateInstrumentationDelegate); ok {
+			del.TruncateAfterLatency(value)
+		}
+	case metrics.IndexSyncCalls:
+		if del, ok := d.Index.(IndexSyncInstrumentationDelegate); ok {
+			del.SyncCalls(value)
+		}
+	case metrics.IndexSyncLatency:
+		if del, ok := d.Index.(IndexSyncInstrumentationDelegate); ok {
+			del.SyncLatency(value)
+		}
+	case metrics.IndexGroupCommitBatchSize:
+		if del, ok := d.Index.(IndexSyncInstrumentationDelegate); ok {
+			del.GroupCommitBatchSize(value)
+		}
 	case metrics.DataManagerWriteLatency:
 		d.DataManager.WriteLatency(value)
 	case metrics.DataManagerWriteCalls:
@@ -85,6 +137,10 @@ func (d *Delegates) Dispatch(kind metrics.MetricKind, value float64) {
 		d.DataManager.VacuumCalls(value)
 	case metrics.DataManagerVacuumLatency:
 		d.DataManager.VacuumLatency(value)
+	case metrics.DataManagerChecksumFailures:
+		if del, ok := d.DataManager.(DataManagerChecksumInstrumentationDelegate); ok {
+			del.ChecksumFailures(value)
+		}
 	case metrics.IndexSegmentFlushMetaCalls:
 		d.IndexSegment.FlushMetaCalls(value)
 	case metrics.IndexSegmentFlushMetaLatency:
@@ -152,3 +208,51 @@ type IndexSegmentInstrumentationDelegate interface {
 	WriteRecordLatency(float64)
 	LoadRecordLatency(float64)
 }
+
+// WriteBatchInstrumentationDelegate may be implemented by a
+// MainInstrumentationDelegate to receive metrics reported once per call to
+// WriteBatch, regardless of the amount of objects it holds.
+type WriteBatchInstrumentationDelegate interface {
+	WriteBatchCalls(float64)
+	WriteBatchLatency(float64)
+	WriteBatchFailures(float64)
+}
+
+// SegmentMappingInstrumentationDelegate may be implemented by a
+// MainInstrumentationDelegate to receive metrics about segments mapped into
+// memory, and about unlinked segments whose disk space is held by readers.
+type SegmentMappingInstrumentationDelegate interface {
+	SegmentsPendingDeletion(float64)
+	SegmentMaps(float64)
+	SegmentUnmaps(float64)
+	MappedBytes(float64)
+}
+
+// IndexAppendBatchInstrumentationDelegate may be implemented by an
+// IndexInstrumentationDelegate to receive metrics about batch appends.
+type IndexAppendBatchInstrumentationDelegate interface {
+	AppendBatchLatency(float64)
+	AppendBatchCalls(float64)
+}
+
+// IndexTruncateInstrumentationDelegate may be implemented by an
+// IndexInstrumentationDelegate to receive metrics about truncations.
+type IndexTruncateInstrumentationDelegate interface {
+	TruncateAfterLatency(float64)
+}
+
+// IndexSyncInstrumentationDelegate may be implemented by an
+// IndexInstrumentationDelegate to receive metrics about syncs, and the
+// amount of appends committed by each group commit batch.
+type IndexSyncInstrumentationDelegate interface {
+	SyncCalls(float64)
+	SyncLatency(float64)
+	GroupCommitBatchSize(float64)
+}
+
+// DataManagerChecksumInstrumentationDelegate may be implemented by a
+// DataManagerInstrumentationDelegate to receive checksum failures detected
+// while reading objects.
+type DataManagerChecksumInstrumentationDelegate interface {
+	ChecksumFailures(float64)
+}
@@ -0,0 +1,55 @@
+package wal
+
+import (
+	"io"
+
+	"github.com/heyvito/wal/internal"
+	"github.com/heyvito/wal/internal/metrics"
+)
+
+// ObjectWriter streams an object of unknown size into the WAL. Bytes are
+// written straight into data segments as they arrive, and the object only
+// becomes visible, under a new record id, once Close returns successfully.
+// In case Abort is called, or the process crashes before Close returns, the
+// partially written object is discarded.
+//
+// As objects are stored contiguously, writes of other objects wait for an
+// open ObjectWriter to be either closed or aborted, and must therefore not be
+// issued from the goroutine using it. Syncing, vacuuming, reading, and
+// closing the WAL proceed meanwhile; closing the WAL aborts the writer.
+type ObjectWriter interface {
+	io.WriteCloser
+
+	// Abort discards all data written so far without publishing the object.
+	Abort() error
+
+	// Receipt describes where the object has been stored. It is only
+	// meaningful after Close returns successfully.
+	Receipt() Receipt
+}
+
+type objectWriter struct {
+	w *internal.ObjectWriter
+}
+
+func (o *objectWriter) Write(p []byte) (int, error) {
+	return o.w.Write(p)
+}
+
+func (o *objectWriter) Close() error {
+	metrics.Simple(metrics.CommonWriteObjectCalls, 0)
+	err := o.w.Close()
+	if err != nil {
+		metrics.Simple(metrics.CommonWriteObjectFailures, 0)
+	}
+	return err
+}
+
+func (o *objectWriter) Abort() error {
+	return o.w.Abort()
+}
+
+func (o *objectWriter) Receipt() Receipt {
+	rec := o.w.Record()
+	return receiptFromRecord(&rec)
+}
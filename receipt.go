@@ -0,0 +1,31 @@
+package wal
+
+import "github.com/heyvito/wal/internal"
+
+// Receipt describes where an object written to the WAL has been stored.
+type Receipt struct {
+	// RecordID represents the id assigned to the object.
+	RecordID int64
+
+	// Size represents the object's size, in bytes.
+	Size int64
+
+	// DataSegmentStartID and DataSegmentEndID represent the first and last
+	// data segments holding the object's data.
+	DataSegmentStartID int64
+	DataSegmentEndID   int64
+
+	// DataSegmentOffset represents the offset within the first data segment
+	// where the object's data starts.
+	DataSegmentOffset int64
+}
+
+func receiptFromRecord(rec *internal.IndexRecord) Receipt {
+	return Receipt{
+		RecordID:           rec.RecordID,
+		Size:               rec.Size,
+		DataSegmentStartID: rec.DataSegmentStartID,
+		DataSegmentEndID:   rec.DataSegmentEndID,
+		DataSegmentOffset:  rec.DataSegmentOffset,
+	}
+}
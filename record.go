@@ -0,0 +1,52 @@
+package wal
+
+import (
+	"io"
+	"iter"
+	"math"
+)
+
+// Record represents an object read from the WAL, along with its id.
+type Record struct {
+	ID   int64
+	Data []byte
+}
+
+func (w *wal) All(from int64) iter.Seq2[Record, error] {
+	return w.Range(from, math.MaxInt64)
+}
+
+func (w *wal) Range(from, to int64) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		cur := w.ReadObjects(from, true)
+		defer func() { _ = cur.Close() }()
+		for cur.Next() {
+			id := cur.Offset()
+			if id > to {
+				return
+			}
+			data, err := readCursor(cur)
+			if err != nil {
+				yield(Record{ID: id}, err)
+				return
+			}
+			if !yield(Record{ID: id, Data: data}, nil) {
+				return
+			}
+		}
+		if err := cur.Err(); err != nil {
+			yield(Record{}, err)
+		}
+	}
+}
+
+func readCursor(cur Cursor) ([]byte, error) {
+	r, err := cur.Read()
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer func() { _ = c.Close() }()
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/heyvito/wal/errors"
+)
+
+// registry tracks the WALs opened for writing by this process, keyed by the
+// canonical path of their WorkDir.
+var registry = struct {
+	sync.Mutex
+	wals map[string]*registration
+}{wals: map[string]*registration{}}
+
+// registration describes a WAL opened for writing by this process. ready is
+// closed once opening it finishes, after which w holds the WAL, or nil in
+// case opening it failed. done is closed once it is removed from the
+// registry, after its last handle is closed. refs holds the amount of open
+// handles, and is only accessed while holding the registry's lock.
+type registration struct {
+	path   string
+	shared bool
+	ready  chan struct{}
+	done   chan struct{}
+	w      *wal
+	refs   int
+}
+
+// openRegistered opens the WAL described by config through open, unless its
+// WorkDir is already open within this process. In that case, a new handle to
+// the existing WAL is returned in case both opens set SharedHandles, or an
+// AlreadyOpenError otherwise. Opens racing with the last handle being closed
+// wait for it to finish closing.
+func openRegistered(config *Config, open func() (*wal, error)) (WAL, error) {
+	path, err := canonicalPath(config.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		registry.Lock()
+		reg, ok := registry.wals[path]
+		switch {
+		case !ok:
+			reg = &registration{
+				path:   path,
+				shared: config.SharedHandles,
+				ready:  make(chan struct{}),
+				done:   make(chan struct{}),
+			}
+			registry.wals[path] = reg
+			registry.Unlock()
+			return reg.open(open)
+
+		case reg.w != nil && reg.refs == 0:
+			// The last handle is being closed.
+			registry.Unlock()
+			<-reg.done
+
+		case !reg.shared || !config.SharedHandles:
+			registry.Unlock()
+			return nil, errors.AlreadyOpenError{WorkDir: path}
+
+		case reg.w == nil:
+			registry.Unlock()
+			<-reg.ready
+
+		default:
+			reg.refs++
+			registry.Unlock()
+			return &wal{
+				config:       reg.w.config,
+				log:          reg.w.log,
+				index:        reg.w.index,
+				flock:        reg.w.flock,
+				registration: reg,
+			}, nil
+		}
+	}
+}
+
+// open opens the registered WAL through fn, removing the registration in
+// case it fails.
+func (r *registration) open(fn func() (*wal, error)) (WAL, error) {
+	w, err := fn()
+	registry.Lock()
+	defer registry.Unlock()
+	defer close(r.ready)
+	if err != nil {
+		delete(registry.wals, r.path)
+		close(r.done)
+		return nil, err
+	}
+	w.registration = r
+	r.w = w
+	r.refs = 1
+	return w, nil
+}
+
+// release drops the reference held by a handle. Returns whether it was the
+// last one, in which case the caller must close the WAL and call unregister.
+func (r *registration) release() bool {
+	registry.Lock()
+	defer registry.Unlock()
+	r.refs--
+	return r.refs == 0
+}
+
+// unregister removes the registration once its WAL is closed.
+func (r *registration) unregister() {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.wals, r.path)
+	close(r.done)
+}
+
+// canonicalPath returns the absolute path of a given directory, with symbolic
+// links resolved, so that every path leading to it yields the same value.
+func canonicalPath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
@@ -0,0 +1,37 @@
+package wal
+
+import "github.com/heyvito/wal/internal"
+
+// SegmentStore provides storage for the files backing the WAL's segments.
+// Use NewMMapStore, NewFileStore or NewMemoryStore to obtain a store, and
+// set it through Config.Store.
+type SegmentStore = internal.SegmentStore
+
+// SegmentFile represents a file opened through a SegmentStore.
+type SegmentFile = internal.SegmentFile
+
+// NewMMapStore returns a store keeping segments in dir, and accessing them
+// through shared memory maps. This is the default store.
+func NewMMapStore(dir string) SegmentStore {
+	return internal.NewMMapStore(dir)
+}
+
+// NewFileStore returns a store keeping segments in dir, and accessing them
+// through regular reads and writes. Segments are read into memory while in
+// use, so Config.MaxMappedBytes also bounds the memory they take. Use it on
+// filesystems where memory maps are unsupported or perform poorly. File
+// stores cannot be used by read-only WALs, as they would not observe changes
+// made by the writer. For the same reason, writers using them read the WAL's
+// epoch from disk before every write in order to be fenced out by writers
+// that take over their WorkDir, which costs opening, reading and closing a
+// file on each write; see WAL.Epoch.
+func NewFileStore(dir string) SegmentStore {
+	return internal.NewFileStore(dir)
+}
+
+// NewMemoryStore returns a store keeping segments in memory, which is useful
+// for tests. Segments survive the WAL being closed and opened again with the
+// same store, but are lost once the process exits.
+func NewMemoryStore() SegmentStore {
+	return internal.NewMemoryStore()
+}
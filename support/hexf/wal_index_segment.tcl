@@ -13,7 +13,9 @@ section "Metadata" {
     set flags [uint8]
     move -1
     set purged [expr $flags & 1 == 1]
+    set checksummed [expr ($flags >> 1) & 1]
     entry "Purged" $purged 1
+    entry "Checksummed" $checksummed 1
     move 1
 }
 
@@ -25,5 +27,8 @@ while {[pos] < [expr $cursor + 49]} {
         uint64 "Data Segment Offset"
         uint64 "Size"
         byte "Flags"
+        if {$checksummed} {
+            hex 4 "Checksum"
+        }
     }
 }
@@ -1,18 +1,18 @@
 package wal
 
 import (
-	"encoding/binary"
+	"encoding/json"
 	errs "errors"
 	"fmt"
 	"github.com/heyvito/wal/internal/metrics"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-stdlog/stdlog"
-	"github.com/shirou/gopsutil/v3/process"
 
 	"github.com/heyvito/wal/errors"
 	"github.com/heyvito/wal/internal"
@@ -22,21 +22,69 @@ import (
 
 type WAL interface {
 	// WriteObject writes a given object to the WAL. Returns an error in case
-	// the write operation fails.
+	// the write operation fails, wrapping errors.ErrNoSpace in case space for
+	// a new segment could not be reserved. Use AppendObject to obtain the id
+	// assigned to the object.
 	WriteObject(data []byte) error
 
+	// AppendObject writes a given object to the WAL, returning a Receipt
+	// describing where it was stored, including its record id. Returns an
+	// error in case the write operation fails.
+	AppendObject(data []byte) (Receipt, error)
+
+	// WriteBatch atomically writes a sequence of objects under contiguous
+	// record ids: after a crash, either all objects are available, or none
+	// is. Returns a Receipt for each object, in the same order they were
+	// provided. Batches must fit a single index segment; larger batches are
+	// rejected with a BatchTooLargeError.
+	WriteBatch(objects [][]byte) ([]Receipt, error)
+
+	// NewObjectWriter returns an ObjectWriter that streams an object of
+	// unknown size into the WAL. Writes of other objects wait for the
+	// returned writer to be either closed or aborted.
+	NewObjectWriter() (ObjectWriter, error)
+
 	// ReadObject attempts to read a previously stored object under a given
-	// id. Either returns an io.Reader for the object's data, or an error. In
-	// case the object has been marked for removal, a NotFoundError is returned.
+	// id. Either returns an io.Reader for the object's data, or an error.
+	// In case the object has been marked for removal, a NotFoundError is
+	// returned. The reader keeps the memory of segments holding the object's
+	// data mapped, even when vacuumed, until it reaches EOF. Readers that are
+	// not read to completion release it once garbage collected, or earlier
+	// when closed through the io.Closer they implement.
 	ReadObject(id int64) (io.Reader, error)
 
 	// ReadObjects returns a new Cursor pointing to either the object under the
 	// specified id, or its right sibling, depending on the value of the
-	// inclusive flag.
+	// inclusive flag. Ids of objects already vacuumed are clamped to
+	// MinimumRecordID.
 	ReadObjects(id int64, inclusive bool) Cursor
 
+	// ReadObjectsSnapshot behaves like ReadObjects, but the returned Cursor
+	// is bounded to the objects available when it was created, from
+	// MinimumRecordID to CurrentRecordID. Objects written afterward are not
+	// visible to it, and objects within its bounds remain readable even if
+	// vacuumed, until the cursor is closed. The disk space taken by segments
+	// holding those objects is only reclaimed once the cursor is closed, and
+	// objects within its bounds cannot be truncated meanwhile.
+	ReadObjectsSnapshot(id int64, inclusive bool) Cursor
+
+	// All returns an iterator over all available objects, starting at the
+	// provided id, up to the end of the WAL. Purged objects, and objects
+	// vacuumed before iteration starts, are skipped. In case an object
+	// cannot be read, or is vacuumed during iteration, the error is yielded
+	// and iteration stops.
+	All(from int64) iter.Seq2[Record, error]
+
+	// Range behaves like All, but stops after the object under id to,
+	// inclusive.
+	Range(from, to int64) iter.Seq2[Record, error]
+
 	// Close flushes all data to disk, and safely closes underlying facilities
-	// of the WAL.
+	// of the WAL. Handles obtained through Config.SharedHandles only close
+	// the WAL once every handle to it is closed. Once a handle is closed,
+	// its methods returning an error return errors.ErrClosed, including
+	// Close itself, and cursors and iterators it returns report it through
+	// their Err.
 	Close() error
 
 	// VacuumRecords marks and removes all records from the storage medium.
@@ -44,6 +92,16 @@ type WAL interface {
 	// the inclusive flag.
 	VacuumRecords(id int64, inclusive bool) error
 
+	// TruncateAfter removes all records with ids greater than the provided
+	// one, so that the next written object receives id+1. Returns a
+	// NotFound error in case the record following id has already been
+	// vacuumed, and a SnapshotInUseError in case records after id are held
+	// by a cursor obtained through ReadObjectsSnapshot that was not closed
+	// yet. Should the process crash during truncation, only part of the
+	// records may have been removed; calling TruncateAfter again completes
+	// the operation.
+	TruncateAfter(id int64) error
+
 	// CountObjects returns the amount of objects after a given id. In case the
 	// inclusive flag is set, the object itself is also accounted in the
 	// returned total.
@@ -56,14 +114,32 @@ type WAL interface {
 	// no item is currently stored, otherwise returns false.
 	IsEmpty() bool
 
-	// MinimumRecordID returns the minimum record available in the WAL. Returns
-	// -1 in case no record is available.
+	// MinimumRecordID returns the minimum record available in the WAL. In
+	// case no record is available, such as after every record is vacuumed,
+	// returns the id the next record will be written under, which is greater
+	// than CurrentRecordID. Returns -1 in case the WAL holds no segments,
+	// which only happens to read-only WALs opened on an empty WorkDir.
 	MinimumRecordID() int64
+
+	// Sync flushes all objects written so far to stable storage, regardless
+	// of the configured SyncPolicy.
+	Sync() error
+
+	// Epoch returns the epoch started when this handle opened the WAL. Every
+	// writer opening a WorkDir starts a new epoch, which is recorded in the
+	// index segments it appends to. Once another writer takes over, writes
+	// through this handle fail with errors.StaleEpochError, allowing
+	// external systems to fence it out by comparing epochs. Handles opened
+	// in read-only mode return the epoch of the last writer that opened the
+	// WAL.
+	Epoch() int64
 }
 
 func New(config Config) (WAL, error) {
 	if config.IndexSegmentSize == 0 {
 		config.IndexSegmentSize = int64(internal.NearestMultiple(64*1024*1024, internal.IndexRecordSize))
+	} else if config.IndexSegmentSize < internal.IndexRecordSize {
+		config.IndexSegmentSize = internal.IndexRecordSize
 	}
 
 	if config.DataSegmentSize == 0 {
@@ -74,16 +150,26 @@ func New(config Config) (WAL, error) {
 		return nil, fmt.Errorf("cannot initialize WAL without WorkDir")
 	}
 
+	if config.SyncPolicy.Mode == internal.SyncModeInterval && config.SyncPolicy.Interval <= 0 {
+		return nil, fmt.Errorf("cannot initialize WAL with a non-positive sync interval")
+	}
+
+	if config.FirstRecordID < 0 {
+		return nil, fmt.Errorf("cannot initialize WAL with a negative FirstRecordID")
+	}
+
 	log := config.GetLogger()
 	log.Info("WAL is initializing",
 		"IndexSegmentSize", config.IndexSegmentSize,
 		"DataSegmentSize", config.DataSegmentSize,
 		"WorkDir", config.WorkDir,
+		"SyncPolicy", config.SyncPolicy,
+		"ReadOnly", config.ReadOnly,
 	)
 
 	stat, err := os.Stat(config.WorkDir)
 	if err != nil {
-		if os.IsNotExist(err) {
+		if os.IsNotExist(err) && !config.ReadOnly {
 			if err = os.Mkdir(config.WorkDir, 0755); err != nil {
 				return nil, err
 			}
@@ -94,16 +180,23 @@ func New(config Config) (WAL, error) {
 		return nil, fmt.Errorf("%s: exists and is not a directory", config.WorkDir)
 	}
 
-	w := &wal{
-		config: &config,
-		log:    log,
+	open := func() (*wal, error) {
+		w := &wal{
+			config: &config,
+			log:    log,
+		}
+		if err := w.initialize(); err != nil {
+			return nil, err
+		}
+		return w, nil
 	}
 
-	if err := w.initialize(); err != nil {
-		return nil, err
+	// Writers are registered, keeping the same WorkDir from being written to
+	// by two WALs within this process.
+	if config.ReadOnly {
+		return open()
 	}
-
-	return w, nil
+	return openRegistered(&config, open)
 }
 
 type wal struct {
@@ -111,18 +204,64 @@ type wal struct {
 	log    stdlog.Logger
 	index  *internal.Index
 	flock  flock.Flock
+
+	// registration describes the WAL in the registry of WALs opened for
+	// writing, and is nil for read-only WALs. Several handles may share it,
+	// along with the index and lock, in case Config.SharedHandles is set.
+	registration *registration
+	closed       atomic.Bool
 }
 
 func (w *wal) initialize() error {
 	w.log.Info("Lock initialization in progress")
-	pid, err := w.initializeLock()
-	if err != nil {
+	if w.config.ReadOnly {
+		if err := w.initializeSharedLock(); err != nil {
+			return err
+		}
+		if err := w.initializeIndex(); err != nil {
+			return err
+		}
+		w.tearDownLock()
+		w.flock = nil
+		return nil
+	}
+	if err := w.acquireLock(); err != nil {
 		return err
 	}
-	if pid != -1 {
-		return errors.CannotAcquireWALLockError{PID: pid}
+	return w.initializeIndex()
+}
+
+// acquireLock obtains the WAL's lock. While the lock is held by another
+// process, attempts are retried with an exponential backoff until
+// Config.LockTimeout elapses, after which a CannotAcquireWALLockError is
+// returned.
+func (w *wal) acquireLock() error {
+	deadline := time.Now().Add(w.config.LockTimeout)
+	backoff := lockRetryMinBackoff
+	for {
+		pid, err := w.initializeLock()
+		if err == nil && pid == -1 {
+			return nil
+		}
+		if w.flock != nil {
+			_ = w.flock.Close()
+			w.flock = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errors.CannotAcquireWALLockError{PID: pid}
+		}
+		w.log.Info("WAL lock is held by another process. Retrying", "pid", pid, "backoff", backoff.String())
+		time.Sleep(min(backoff, remaining))
+		backoff = min(2*backoff, lockRetryMaxBackoff)
 	}
+}
 
+func (w *wal) initializeIndex() error {
 	done := metrics.Measure(metrics.CommonIndexInitializationTiming)
 	indexInitStart := time.Now()
 	idx, err := internal.NewIndex(w.config)
@@ -138,19 +277,25 @@ func (w *wal) initialize() error {
 	return nil
 }
 
+// initializeLock attempts to obtain the WAL's lock. Returns the PID of the
+// process holding it in case it cannot be obtained, or -1 otherwise.
 func (w *wal) initializeLock() (int, error) {
-	lockPath := filepath.Join(w.config.WorkDir, "lock")
+	lockPath := filepath.Join(w.config.WorkDir, lockFileName)
 	var err error
 	w.flock, err = flock.New(lockPath)
 	if err != nil {
 		return -1, err
 	}
-	if err = w.flock.Lock(); err != nil {
+	if err = w.flock.Lock(); errs.Is(err, flock.CannotLockErr) {
+		// The holder may not have recorded itself yet, in which case its
+		// PID is reported as zero.
+		info, _ := readLockInfo(w.flock)
+		return info.PID, nil
+	} else if err != nil {
 		return -1, err
 	}
-	data := make([]byte, 16)
-	l, err := w.flock.Read(data)
-	if err != nil && err != io.EOF {
+	info, err := readLockInfo(w.flock)
+	if err != nil {
 		err = fmt.Errorf("failed reading lock file: %w", err)
 		if unlockErr := w.flock.Unlock(); unlockErr != nil {
 			return -1, errs.Join(err, unlockErr)
@@ -158,109 +303,101 @@ func (w *wal) initializeLock() (int, error) {
 		return -1, err
 	}
 
-	if l == 0 {
-		return w.writePidToLock()
+	if info.PID == 0 {
+		return w.writeLockInfo()
 	}
 
-	pid := binary.BigEndian.Uint64(data)
-	proc, err := process.NewProcess(int32(pid))
-	if err != nil && errs.Is(err, process.ErrorProcessNotRunning) {
-		return w.writePidToLock()
+	// The lock file records a process that does not hold the lock anymore.
+	// It is only overridden once that process is known to be gone: it is not
+	// running, it is a zombie, or its PID has been reused by another process,
+	// which is detected by comparing start times. Lock files written by
+	// older versions carry no start time, in which case a process running
+	// under the recorded PID is assumed to be the one that wrote it.
+	pid := info.PID
+	startTime, err := procutils.GetPIDStartTime(pid)
+	if errs.Is(err, procutils.ErrNotFound) {
+		return w.writeLockInfo()
 	} else if err != nil {
-		err = fmt.Errorf("failed querying pid %d: %w", pid, err)
+		err = fmt.Errorf("failed querying pid %d start time: %w", pid, err)
 		if unlockErr := w.flock.Unlock(); unlockErr != nil {
 			return -1, errs.Join(err, unlockErr)
 		}
 		return -1, err
 	}
+	if !info.StartTime.IsZero() && !sameStartTime(startTime, info.StartTime) {
+		return w.writeLockInfo()
+	}
 
-	running, err := proc.IsRunning()
-	if err != nil {
-		err = fmt.Errorf("failed querying pid %d status: %w", pid, err)
+	state, err := procutils.GetPIDState(pid)
+	if errs.Is(err, procutils.ErrNotFound) {
+		return w.writeLockInfo()
+	} else if err != nil {
+		// At this point we can't continue for sure. Let's bail as we can't
+		// guarantee system consistency.
+		err = fmt.Errorf("failed querying pid %d state: %w. System consistency cannot be guaranteed", pid, err)
 		if unlockErr := w.flock.Unlock(); unlockErr != nil {
 			return -1, errs.Join(err, unlockErr)
 		}
 		return -1, err
 	}
-	if !running {
-		return w.writePidToLock()
+	if state&procutils.StateDefunct == procutils.StateDefunct {
+		return w.writeLockInfo()
 	}
 
-	cmd, err := proc.CmdlineSlice()
-	if err != nil && !errs.Is(err, syscall.EINVAL) {
-		err = fmt.Errorf("failed querying pid %d cmdline: %w", pid, err)
-		if unlockErr := w.flock.Unlock(); unlockErr != nil {
-			return -1, errs.Join(err, unlockErr)
-		}
-		return -1, err
+	// The recorded process is alive. Unless it is this very process, which
+	// already released the lock, it is considered to hold the lock.
+	if pid != os.Getpid() {
+		return pid, nil
 	}
+	return w.writeLockInfo()
+}
 
-	// Here, if we have a cmdslice with zero length, this may indicate a zombie
-	// process. It's a huge edge case, but could be observed on a
-	// non-virtualised environment.
-	if len(cmd) == 0 {
-		var state procutils.ProcessState
-		state, err = procutils.GetPIDState(int(pid))
-		if err != nil {
-			// At this point we can't continue for sure. Let's bail as we can't
-			// guarantee system consistency.
-			err = fmt.Errorf("failed querying pid %d state: %w. System consistency cannot be guaranteed", pid, err)
-			if unlockErr := w.flock.Unlock(); unlockErr != nil {
-				return -1, errs.Join(err, unlockErr)
-			}
-			return -1, err
-		}
-
-		if state&procutils.StateDefunct == procutils.StateDefunct {
-			return w.writePidToLock()
-		}
-
-		err = fmt.Errorf("lock is being held by a possible zombie process %d with no zombie flag set", pid)
-		return -1, err
+// initializeSharedLock obtains a shared lock on the WAL's lock file, keeping
+// writers from opening, and possibly recovering, the WAL while its index is
+// loaded. The lock is released once loading finishes, so that writers may
+// open the WAL while it is read. In case a writer already holds the lock, or
+// no lock file exists, the WAL is loaded without a lock.
+func (w *wal) initializeSharedLock() error {
+	lockPath := filepath.Join(w.config.WorkDir, lockFileName)
+	f, err := flock.Open(lockPath)
+	if os.IsNotExist(err) {
+		w.log.Info("No lock file found. Reading without a lock")
+		return nil
+	} else if err != nil {
+		return err
 	}
-
-	// At this point, there's a process, and although it  has not a lease on the
-	// lockfile, its PID is registered. Just make sure it is not the same
-	// process as ours.
-	currentExec, err := os.Executable()
-	if err != nil {
-		err = fmt.Errorf("failed querying current executable path: %w", err)
-		err = fmt.Errorf("failed querying pid %d: %w", pid, err)
-		if unlockErr := w.flock.Unlock(); unlockErr != nil {
-			return -1, errs.Join(err, unlockErr)
-		}
-		return -1, err
+	if err = f.LockShared(); errs.Is(err, flock.CannotLockErr) {
+		w.log.Info("WAL is locked by a writer. Reading without a lock")
+		return f.Close()
+	} else if err != nil {
+		_ = f.Close()
+		return err
 	}
+	w.flock = f
+	return nil
+}
 
-	if cmd[0] == currentExec {
-		// There's one last thing to check: whether we are not the PID that has
-		// locked the file. This may happen in cases such as virtualization
-		// environments like containers. At this point, we are sure we are
-		// virtually the same process that obtained the lock, but we may always
-		// have a static PID such as 1.
-		if int(pid) != os.Getpid() {
-
-			// It's not the case. The file belongs to some other process.
-			return int(pid), nil
-		}
+// tearDownLock releases the WAL's lock. Writers remove the lock file, while
+// readers leave it in place, as it may be shared with other readers.
+func (w *wal) tearDownLock() {
+	switch {
+	case w.flock == nil:
+	case w.config.ReadOnly:
+		_ = w.flock.Close()
+	default:
+		_ = w.flock.Remove()
 	}
-
-	// Otherwise, the process that owned the lock has died, and another process
-	// already took its PID. It's safe to override.
-
-	return w.writePidToLock()
 }
 
-func (w *wal) tearDownLock() { _ = w.flock.Remove() }
-
-func (w *wal) writePidToLock() (int, error) {
-	currentPid := os.Getpid()
-	data := make([]byte, 8)
-	binary.BigEndian.PutUint64(data, uint64(currentPid))
-	err := w.flock.Write(data)
+// writeLockInfo records the current process as the holder of the lock.
+func (w *wal) writeLockInfo() (int, error) {
+	data, err := json.Marshal(currentLockInfo())
+	if err == nil {
+		err = w.flock.Write(data)
+	}
 	if err != nil {
 		if unlockErr := w.flock.Unlock(); unlockErr != nil {
-			return -1, errs.Join(fmt.Errorf("failed writing current pid to lockfile: %w", err), unlockErr)
+			return -1, errs.Join(fmt.Errorf("failed writing lock information to lockfile: %w", err), unlockErr)
 		}
 		return -1, err
 	}
@@ -268,17 +405,60 @@ func (w *wal) writePidToLock() (int, error) {
 }
 
 func (w *wal) WriteObject(data []byte) error {
+	_, err := w.AppendObject(data)
+	return err
+}
+
+func (w *wal) AppendObject(data []byte) (Receipt, error) {
+	if w.closed.Load() {
+		return Receipt{}, errors.ErrClosed
+	}
 	metrics.Simple(metrics.CommonWriteObjectCalls, 0)
 	defer metrics.Measure(metrics.CommonWriteObjectLatency)()
 	rec := &internal.IndexRecord{}
-	err := w.index.Append(data, rec)
-	if err != nil {
+	if err := w.index.Append(data, rec); err != nil {
 		metrics.Simple(metrics.CommonWriteObjectFailures, 0)
+		return Receipt{}, err
 	}
-	return err
+	return receiptFromRecord(rec), nil
+}
+
+func (w *wal) WriteBatch(objects [][]byte) ([]Receipt, error) {
+	if w.closed.Load() {
+		return nil, errors.ErrClosed
+	}
+	metrics.Simple(metrics.CommonWriteBatchCalls, 0)
+	defer metrics.Measure(metrics.CommonWriteBatchLatency)()
+	recs := make([]*internal.IndexRecord, len(objects))
+	for n := range recs {
+		recs[n] = &internal.IndexRecord{}
+	}
+	if err := w.index.AppendBatch(objects, recs); err != nil {
+		metrics.Simple(metrics.CommonWriteBatchFailures, 0)
+		return nil, err
+	}
+	receipts := make([]Receipt, len(recs))
+	for n, rec := range recs {
+		receipts[n] = receiptFromRecord(rec)
+	}
+	return receipts, nil
+}
+
+func (w *wal) NewObjectWriter() (ObjectWriter, error) {
+	if w.closed.Load() {
+		return nil, errors.ErrClosed
+	}
+	ow, err := w.index.NewObjectWriter()
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{w: ow}, nil
 }
 
 func (w *wal) ReadObject(id int64) (io.Reader, error) {
+	if w.closed.Load() {
+		return nil, errors.ErrClosed
+	}
 	metrics.Simple(metrics.CommonReadObjectCalls, 0)
 	defer metrics.Measure(metrics.CommonReadObjectLatency)()
 
@@ -298,10 +478,29 @@ func (w *wal) ReadObject(id int64) (io.Reader, error) {
 }
 
 func (w *wal) ReadObjects(id int64, inclusive bool) Cursor {
+	if w.closed.Load() {
+		return closedCursor{}
+	}
 	return w.index.ReadObjects(id, inclusive)
 }
 
+func (w *wal) ReadObjectsSnapshot(id int64, inclusive bool) Cursor {
+	if w.closed.Load() {
+		return closedCursor{}
+	}
+	return w.index.ReadObjectsSnapshot(id, inclusive)
+}
+
 func (w *wal) Close() error {
+	if w.closed.Swap(true) {
+		return errors.ErrClosed
+	}
+	if w.registration != nil {
+		if !w.registration.release() {
+			return nil
+		}
+		defer w.registration.unregister()
+	}
 	if err := w.index.Close(); err != nil {
 		return err
 	}
@@ -310,9 +509,19 @@ func (w *wal) Close() error {
 }
 
 func (w *wal) VacuumRecords(id int64, inclusive bool) error {
+	if w.closed.Load() {
+		return errors.ErrClosed
+	}
 	return w.index.VacuumObjects(id, inclusive)
 }
 
+func (w *wal) TruncateAfter(id int64) error {
+	if w.closed.Load() {
+		return errors.ErrClosed
+	}
+	return w.index.TruncateAfter(id)
+}
+
 func (w *wal) CountObjects(id int64, inclusive bool) int64 {
 	defer metrics.Measure(metrics.CommonCountObjectsTiming)()
 	return w.index.CountObjects(id, inclusive)
@@ -329,3 +538,14 @@ func (w *wal) IsEmpty() bool {
 func (w *wal) MinimumRecordID() int64 {
 	return w.index.MinimumRecordID()
 }
+
+func (w *wal) Sync() error {
+	if w.closed.Load() {
+		return errors.ErrClosed
+	}
+	return w.index.Sync()
+}
+
+func (w *wal) Epoch() int64 {
+	return w.index.Epoch()
+}
@@ -1,20 +1,34 @@
 package wal
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	errs "errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/go-stdlog/stdlog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/heyvito/wal/errors"
 	"github.com/heyvito/wal/internal"
+	"github.com/heyvito/wal/internal/flock"
+	"github.com/heyvito/wal/internal/procutils"
 )
 
 // TestWALWriteReadSingle tests a simple create -> write -> close -> open ->
@@ -576,6 +590,7 @@ func TestWALMinimumRecordID(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.True(t, w.IsEmpty(), "expected new WAL to be empty")
+	assert.Equal(t, int64(0), w.MinimumRecordID())
 
 	for i := range 1000 {
 		err = w.WriteObject([]byte("object " + strconv.Itoa(i)))
@@ -597,6 +612,1074 @@ func TestWALMinimumRecordID(t *testing.T) {
 	assert.Equal(t, int64(999), w.CurrentRecordID())
 
 	assert.Equal(t, int64(101), w.MinimumRecordID())
+
+	// Once every object is vacuumed, the next id to be written is returned.
+	err = w.VacuumRecords(w.CurrentRecordID(), true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(999), w.CurrentRecordID())
+	assert.Equal(t, int64(1000), w.MinimumRecordID())
 	err = w.Close()
 	require.NoError(t, err)
+
+	w, err = New(conf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), w.MinimumRecordID())
+	err = w.Close()
+	require.NoError(t, err)
+}
+
+// syncTrackingStore tracks changes made through it that were not synced yet:
+// files created since the directory was last synced, and files holding
+// flushed ranges that were not synced since. Syncing any range of a file
+// is considered to sync all of its ranges. Syncing files fails with failSync
+// while it is set.
+type syncTrackingStore struct {
+	SegmentStore
+	mu       sync.Mutex
+	created  int
+	dirty    map[*syncTrackingFile]bool
+	failSync error
+}
+
+func newSyncTrackingStore(dir string) *syncTrackingStore {
+	return &syncTrackingStore{SegmentStore: NewMMapStore(dir), dirty: map[*syncTrackingFile]bool{}}
+}
+
+func (s *syncTrackingStore) Create(name string, size int64) error {
+	err := s.SegmentStore.Create(name, size)
+	if err == nil {
+		s.mu.Lock()
+		s.created++
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *syncTrackingStore) Open(name string) (SegmentFile, error) {
+	f, err := s.SegmentStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncTrackingFile{SegmentFile: f, store: s}, nil
+}
+
+func (s *syncTrackingStore) Sync() error {
+	s.mu.Lock()
+	s.created = 0
+	s.mu.Unlock()
+	return s.SegmentStore.Sync()
+}
+
+// unsynced returns the amount of changes that were not synced yet.
+func (s *syncTrackingStore) unsynced() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.created + len(s.dirty)
+}
+
+func (s *syncTrackingStore) setFailSync(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failSync = err
+}
+
+type syncTrackingFile struct {
+	SegmentFile
+	store *syncTrackingStore
+}
+
+func (f *syncTrackingFile) Flush(offset, size int64) {
+	f.SegmentFile.Flush(offset, size)
+	f.store.mu.Lock()
+	f.store.dirty[f] = true
+	f.store.mu.Unlock()
+}
+
+func (f *syncTrackingFile) Sync(offset, size int64) error {
+	f.store.mu.Lock()
+	if err := f.store.failSync; err != nil {
+		f.store.mu.Unlock()
+		return err
+	}
+	delete(f.store.dirty, f)
+	f.store.mu.Unlock()
+	return f.SegmentFile.Sync(offset, size)
+}
+
+func (f *syncTrackingFile) Close() error {
+	f.store.mu.Lock()
+	delete(f.store.dirty, f)
+	f.store.mu.Unlock()
+	return f.SegmentFile.Close()
+}
+
+// TestWALSyncPolicies ensures each sync policy syncs what it promises, and
+// that objects written under them are readable after reopening the WAL.
+func TestWALSyncPolicies(t *testing.T) {
+	policies := map[string]SyncPolicy{
+		"None":       SyncNone(),
+		"EveryWrite": SyncEveryWrite(),
+		"Interval":   SyncInterval(time.Millisecond),
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := newSyncTrackingStore(dir)
+			conf := Config{
+				DataSegmentSize:  64,
+				IndexSegmentSize: 92,
+				WorkDir:          dir,
+				Logger:           stdlog.Discard,
+				SyncPolicy:       policy,
+				Store:            store,
+			}
+			w, err := New(conf)
+			require.NoError(t, err)
+
+			// Writes rotate both data and index segments.
+			for i := range 20 {
+				err = w.WriteObject([]byte("object " + strconv.Itoa(i)))
+				require.NoError(t, err)
+				if policy == SyncEveryWrite() {
+					require.Zero(t, store.unsynced(), "object %d", i)
+				}
+			}
+			switch policy {
+			case SyncNone():
+				assert.NotZero(t, store.unsynced())
+			case SyncInterval(time.Millisecond):
+				assert.Eventually(t, func() bool { return store.unsynced() == 0 }, 5*time.Second, time.Millisecond)
+			}
+			require.NoError(t, w.Sync())
+			assert.Zero(t, store.unsynced())
+			require.NoError(t, w.Close())
+
+			w, err = New(conf)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, w.Close()) }()
+
+			r, err := w.ReadObject(19)
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "object 19", string(data))
+		})
+	}
+}
+
+// TestWALSyncFailure ensures records whose sync fails under SyncEveryWrite
+// are never published, and that further writes are rejected.
+func TestWALSyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	store := newSyncTrackingStore(dir)
+	w, err := New(Config{
+		WorkDir:    dir,
+		Logger:     stdlog.Discard,
+		SyncPolicy: SyncEveryWrite(),
+		Store:      store,
+	})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	require.NoError(t, w.WriteObject([]byte("synced")))
+	cur := w.ReadObjects(0, false)
+
+	// Cursors waiting for new objects are only woken once they are synced.
+	store.setFailSync(syscall.EIO)
+	waiter := w.ReadObjects(0, false)
+	woken := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		woken <- waiter.NextWait(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.ErrorIs(t, w.WriteObject([]byte("failed")), syscall.EIO)
+	assert.False(t, <-woken)
+	assert.ErrorIs(t, waiter.Err(), context.DeadlineExceeded)
+	require.NoError(t, waiter.Close())
+
+	assert.Equal(t, int64(0), w.CurrentRecordID())
+	_, err = w.ReadObject(1)
+	assert.ErrorAs(t, err, &errors.NotFound{})
+	assert.False(t, cur.Next())
+
+	store.setFailSync(nil)
+	assert.ErrorIs(t, w.WriteObject([]byte("rejected")), syscall.EIO)
+	_, err = w.WriteBatch([][]byte{[]byte("rejected")})
+	assert.ErrorIs(t, err, syscall.EIO)
+	assert.Equal(t, int64(0), w.CurrentRecordID())
+}
+
+func TestWALInvalidSyncInterval(t *testing.T) {
+	_, err := New(Config{WorkDir: t.TempDir(), SyncPolicy: SyncInterval(0)})
+	assert.Error(t, err)
+}
+
+// TestWALAppendObject ensures receipts returned by AppendObject point to the
+// objects they describe, including when objects span several data segments.
+func TestWALAppendObject(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: 1024,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	first, err := w.AppendObject([]byte("Hello, World!"))
+	require.NoError(t, err)
+	assert.Equal(t, Receipt{RecordID: 0, Size: 13}, first)
+
+	big := make([]byte, 100)
+	_, err = rand.Read(big)
+	require.NoError(t, err)
+	second, err := w.AppendObject(big)
+	require.NoError(t, err)
+	assert.Equal(t, Receipt{
+		RecordID:           1,
+		Size:               100,
+		DataSegmentStartID: 0,
+		DataSegmentEndID:   1,
+		DataSegmentOffset:  13,
+	}, second)
+	assert.Equal(t, second.RecordID, w.CurrentRecordID())
+
+	r, err := w.ReadObject(second.RecordID)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, big, data)
+}
+
+// TestWALWriteBatch ensures objects written through WriteBatch receive
+// contiguous ids, and are all readable after reopening the WAL.
+func TestWALWriteBatch(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: 1024,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	require.NoError(t, w.WriteObject([]byte("first")))
+	objects := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	receipts, err := w.WriteBatch(objects)
+	require.NoError(t, err)
+	require.Len(t, receipts, 3)
+	for n, r := range receipts {
+		assert.Equal(t, int64(n+1), r.RecordID)
+	}
+	require.NoError(t, w.Close())
+
+	w, err = New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+	assert.Equal(t, int64(3), w.CurrentRecordID())
+	for n, obj := range objects {
+		r, err := w.ReadObject(int64(n + 1))
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, obj, data)
+	}
+}
+
+// TestWALObjectWriter streams an object spanning several data segments, and
+// ensures it is readable once the writer is closed.
+func TestWALObjectWriter(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: 1024,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	ow, err := w.NewObjectWriter()
+	require.NoError(t, err)
+	payload := make([]byte, 500)
+	_, err = rand.Read(payload)
+	require.NoError(t, err)
+	_, err = io.Copy(ow, bytes.NewReader(payload))
+	require.NoError(t, err)
+	require.NoError(t, ow.Close())
+	assert.Equal(t, int64(0), ow.Receipt().RecordID)
+	assert.Equal(t, int64(500), ow.Receipt().Size)
+
+	ow, err = w.NewObjectWriter()
+	require.NoError(t, err)
+	_, err = ow.Write([]byte("discarded"))
+	require.NoError(t, err)
+	require.NoError(t, ow.Abort())
+	assert.Equal(t, int64(0), w.CurrentRecordID())
+
+	r, err := w.ReadObject(0)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, payload, data)
+}
+
+// TestWALTruncateAfter removes the tail of the WAL and ensures records are
+// re-appended from the truncation point, both before and after reopening it.
+func TestWALTruncateAfter(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          dir,
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	objects := make([][]byte, 10)
+	for i := range objects {
+		objects[i] = []byte(fmt.Sprintf("object %012d", i))
+		require.NoError(t, w.WriteObject(objects[i]))
+	}
+
+	assertObjects := func(t *testing.T, w WAL, objects [][]byte) {
+		t.Helper()
+		require.Equal(t, int64(len(objects)-1), w.CurrentRecordID())
+		for i, obj := range objects {
+			r, err := w.ReadObject(int64(i))
+			require.NoError(t, err)
+			data, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, obj, data)
+		}
+	}
+
+	t.Run("Truncate within a segment", func(t *testing.T) {
+		require.NoError(t, w.TruncateAfter(4))
+		assert.NoFileExists(t, filepath.Join(dir, "index0003"))
+		assert.NoFileExists(t, filepath.Join(dir, "index0004"))
+		assert.NoFileExists(t, filepath.Join(dir, "data0002"))
+		_, err := w.ReadObject(5)
+		assert.ErrorAs(t, err, &errors.NotFound{})
+
+		objects = objects[:5]
+		objects = append(objects, []byte("replacement 5"))
+		require.NoError(t, w.WriteObject(objects[5]))
+		assertObjects(t, w, objects)
+	})
+
+	t.Run("Truncate at a segment boundary", func(t *testing.T) {
+		require.NoError(t, w.TruncateAfter(3))
+		assert.NoFileExists(t, filepath.Join(dir, "index0002"))
+
+		objects = objects[:4]
+		objects = append(objects, []byte("replacement 4"))
+		require.NoError(t, w.WriteObject(objects[4]))
+		assertObjects(t, w, objects)
+	})
+
+	t.Run("Truncate after reopening", func(t *testing.T) {
+		require.NoError(t, w.Close())
+		w, err = New(conf)
+		require.NoError(t, err)
+		assertObjects(t, w, objects)
+
+		require.NoError(t, w.TruncateAfter(0))
+		objects = objects[:1]
+		assertObjects(t, w, objects)
+		require.NoError(t, w.Close())
+
+		w, err = New(conf)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, w.Close()) }()
+		assertObjects(t, w, objects)
+	})
+}
+
+// TestWALVacuumKeepsRecordIDs ensures record ids keep increasing after every
+// record has been vacuumed, including across restarts.
+func TestWALVacuumKeepsRecordIDs(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	for i := range 5 {
+		require.NoError(t, w.WriteObject([]byte("object "+strconv.Itoa(i))))
+	}
+
+	require.NoError(t, w.VacuumRecords(w.CurrentRecordID(), true))
+	assert.True(t, w.IsEmpty())
+	assert.Equal(t, int64(4), w.CurrentRecordID())
+
+	receipt, err := w.AppendObject([]byte("object 5"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), receipt.RecordID)
+
+	require.NoError(t, w.VacuumRecords(w.CurrentRecordID(), true))
+	require.NoError(t, w.Close())
+
+	w, err = New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.True(t, w.IsEmpty())
+	assert.Equal(t, int64(5), w.CurrentRecordID())
+
+	receipt, err = w.AppendObject([]byte("object 6"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), receipt.RecordID)
+
+	r, err := w.ReadObject(6)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("object 6"), data)
+}
+
+// TestWALFirstRecordID ensures a new WAL assigns ids starting from the
+// configured FirstRecordID.
+func TestWALFirstRecordID(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+		FirstRecordID:    1,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	assert.True(t, w.IsEmpty())
+	assert.Equal(t, int64(0), w.CurrentRecordID())
+
+	for i := range 3 {
+		receipt, err := w.AppendObject([]byte("object " + strconv.Itoa(i)))
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), receipt.RecordID)
+	}
+	assert.Equal(t, int64(1), w.MinimumRecordID())
+	require.NoError(t, w.Close())
+
+	conf.FirstRecordID = 100
+	w, err = New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	assert.Equal(t, int64(3), w.CurrentRecordID())
+	assert.Equal(t, int64(1), w.MinimumRecordID())
+	_, err = New(Config{WorkDir: t.TempDir(), FirstRecordID: -1})
+	assert.Error(t, err)
+}
+
+// TestWALIterators exercises All and Range, including stopping iteration
+// early.
+func TestWALIterators(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 4,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	for i := range 10 {
+		require.NoError(t, w.WriteObject([]byte("object "+strconv.Itoa(i))))
+	}
+
+	t.Run("All", func(t *testing.T) {
+		var ids []int64
+		for rec, err := range w.All(4) {
+			require.NoError(t, err)
+			assert.Equal(t, "object "+strconv.FormatInt(rec.ID, 10), string(rec.Data))
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{4, 5, 6, 7, 8, 9}, ids)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		var ids []int64
+		for rec, err := range w.Range(2, 5) {
+			require.NoError(t, err)
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{2, 3, 4, 5}, ids)
+	})
+
+	t.Run("Break", func(t *testing.T) {
+		var ids []int64
+		for rec, err := range w.All(0) {
+			require.NoError(t, err)
+			if rec.ID == 2 {
+				break
+			}
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{0, 1}, ids)
+	})
+
+	t.Run("Vacuumed", func(t *testing.T) {
+		require.NoError(t, w.VacuumRecords(3, true))
+		var ids []int64
+		for rec, err := range w.All(0) {
+			require.NoError(t, err)
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{4, 5, 6, 7, 8, 9}, ids)
+
+		ids = nil
+		for rec, err := range w.Range(1, 5) {
+			require.NoError(t, err)
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{4, 5}, ids)
+
+		ids = nil
+		for rec, err := range w.All(4) {
+			if rec.ID == 6 {
+				require.NoError(t, w.VacuumRecords(8, true))
+			}
+			if err != nil {
+				assert.ErrorAs(t, err, &errors.VacuumedError{})
+				break
+			}
+			ids = append(ids, rec.ID)
+		}
+		assert.Equal(t, []int64{4, 5, 6}, ids)
+	})
+}
+
+// TestWALSnapshotCursor ensures snapshot cursors are bounded to the objects
+// available when they were created, and that they keep reading segments
+// vacuumed from under them until they are closed.
+func TestWALSnapshotCursor(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          dir,
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	for i := range 6 {
+		require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("object %012d", i))))
+	}
+
+	cur := w.ReadObjectsSnapshot(0, true)
+	require.True(t, cur.Next())
+	assert.Equal(t, int64(0), cur.Offset())
+
+	require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("object %012d", 6))))
+	require.NoError(t, w.VacuumRecords(5, true))
+	assert.NoFileExists(t, filepath.Join(dir, "index0000"))
+	assert.FileExists(t, filepath.Join(dir, "data0000"))
+
+	live := w.ReadObjects(0, true)
+	require.True(t, live.Next())
+	assert.Equal(t, int64(6), live.Offset())
+
+	for i := int64(1); i < 6; i++ {
+		require.True(t, cur.Next())
+		require.Equal(t, i, cur.Offset())
+		r, err := cur.Read()
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("object %012d", i), string(data))
+	}
+	assert.False(t, cur.Next())
+	assert.NoError(t, cur.Err())
+
+	require.NoError(t, cur.Close())
+	assert.NoFileExists(t, filepath.Join(dir, "index0000"))
+	assert.NoFileExists(t, filepath.Join(dir, "index0002"))
+	assert.NoFileExists(t, filepath.Join(dir, "data0000"))
+}
+
+// TestWALSnapshotTruncate ensures records held by snapshot cursors cannot be
+// truncated, so that appends never overwrite them.
+func TestWALSnapshotTruncate(t *testing.T) {
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          t.TempDir(),
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	for i := range 5 {
+		require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("object %012d", i))))
+	}
+	cur := w.ReadObjectsSnapshot(0, true)
+
+	var inUse errors.SnapshotInUseError
+	require.ErrorAs(t, w.TruncateAfter(2), &inUse)
+	assert.Equal(t, errors.SnapshotInUseError{RecordID: 2, Upper: 4}, inUse)
+	assert.Equal(t, int64(4), w.CurrentRecordID())
+
+	// Records written after the snapshot was taken may be truncated.
+	for i := 5; i < 7; i++ {
+		require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("object %012d", i))))
+	}
+	require.NoError(t, w.TruncateAfter(4))
+	for i := 5; i < 7; i++ {
+		require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("append %012d", i))))
+	}
+
+	for i := int64(0); i < 5; i++ {
+		require.True(t, cur.Next())
+		require.Equal(t, i, cur.Offset())
+		r, err := cur.Read()
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("object %012d", i), string(data))
+	}
+	assert.False(t, cur.Next())
+	require.NoError(t, cur.Close())
+
+	require.NoError(t, w.TruncateAfter(2))
+	assert.Equal(t, int64(2), w.CurrentRecordID())
+}
+
+// TestWALReaderOutlivesVacuum ensures readers keep reading segments vacuumed
+// from under them, whose files are removed right away.
+func TestWALReaderOutlivesVacuum(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		DataSegmentSize:  32,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          dir,
+		Logger:           stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+
+	for i := range 4 {
+		require.NoError(t, w.WriteObject([]byte(fmt.Sprintf("object %024d", i))))
+	}
+
+	drained, err := w.ReadObject(0)
+	require.NoError(t, err)
+	closed, err := w.ReadObject(1)
+	require.NoError(t, err)
+
+	require.NoError(t, w.VacuumRecords(2, true))
+	assert.NoFileExists(t, filepath.Join(dir, "data0000"))
+	assert.NoFileExists(t, filepath.Join(dir, "data0001"))
+
+	data, err := io.ReadAll(drained)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("object %024d", 0), string(data))
+
+	// Object 1 starts at the end of data0000.
+	head := make([]byte, 6)
+	_, err = io.ReadFull(closed, head)
+	require.NoError(t, err)
+	assert.Equal(t, "object", string(head))
+	require.NoError(t, closed.(io.Closer).Close())
+}
+
+// TestWALTruncateReusesSegmentIDs ensures segments removed while referenced
+// by readers do not take segments later created under the same id with them.
+func TestWALTruncateReusesSegmentIDs(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		DataSegmentSize: 32,
+		WorkDir:         dir,
+		Logger:          stdlog.Discard,
+	}
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	object := func(i int) []byte { return []byte(fmt.Sprintf("object %024d", i)) }
+	for i := range 4 {
+		require.NoError(t, w.WriteObject(object(i)))
+	}
+	reader, err := w.ReadObject(3)
+	require.NoError(t, err)
+
+	require.NoError(t, w.TruncateAfter(0))
+	for i := 1; i < 5; i++ {
+		require.NoError(t, w.WriteObject(object(i)))
+	}
+	require.NoError(t, reader.(io.Closer).Close())
+	require.NoError(t, w.Close())
+
+	w, err = New(conf)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+	for i := range 5 {
+		r, err := w.ReadObject(int64(i))
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, object(i), data)
+	}
+}
+
+func TestWALStores(t *testing.T) {
+	stores := map[string]func(dir string) SegmentStore{
+		"mmap":   NewMMapStore,
+		"file":   NewFileStore,
+		"memory": func(string) SegmentStore { return NewMemoryStore() },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			conf := Config{
+				DataSegmentSize:  64,
+				IndexSegmentSize: internal.IndexRecordSize * 2,
+				WorkDir:          dir,
+				Logger:           stdlog.Discard,
+				SyncPolicy:       SyncEveryWrite(),
+				MaxOpenSegments:  3,
+				Store:            newStore(dir),
+			}
+			w, err := New(conf)
+			require.NoError(t, err)
+
+			for i := range 10 {
+				require.NoError(t, w.WriteObject([]byte("object number "+strconv.Itoa(i))))
+			}
+			require.NoError(t, w.VacuumRecords(3, true))
+			require.NoError(t, w.Close())
+
+			w, err = New(conf)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, w.Close()) }()
+
+			assert.Equal(t, int64(4), w.MinimumRecordID())
+			assert.Equal(t, int64(9), w.CurrentRecordID())
+			for i := 4; i < 10; i++ {
+				r, err := w.ReadObject(int64(i))
+				require.NoError(t, err)
+				data, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, "object number "+strconv.Itoa(i), string(data))
+			}
+
+			// Only the memory store keeps segments out of WorkDir.
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			hasSegments := slices.ContainsFunc(entries, func(e os.DirEntry) bool {
+				return strings.HasPrefix(e.Name(), "index")
+			})
+			assert.Equal(t, name != "memory", hasSegments)
+		})
+	}
+}
+
+func TestWALReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		DataSegmentSize:  64,
+		IndexSegmentSize: internal.IndexRecordSize * 2,
+		WorkDir:          dir,
+		Logger:           stdlog.Discard,
+	}
+	roConf := conf
+	roConf.ReadOnly = true
+
+	_, err := New(Config{WorkDir: filepath.Join(dir, "missing"), ReadOnly: true})
+	require.Error(t, err)
+
+	w, err := New(conf)
+	require.NoError(t, err)
+
+	// The writer holds the lock, so the reader follows it without one.
+	r, err := New(roConf)
+	require.NoError(t, err)
+
+	for i := range 10 {
+		require.NoError(t, w.WriteObject([]byte("object number "+strconv.Itoa(i))))
+	}
+	assert.Eventually(t, func() bool { return r.CurrentRecordID() == 9 }, 5*time.Second, 10*time.Millisecond)
+	for i := range 10 {
+		reader, err := r.ReadObject(int64(i))
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "object number "+strconv.Itoa(i), string(data))
+	}
+
+	assert.ErrorIs(t, r.WriteObject([]byte("data")), errors.ErrReadOnly)
+	assert.ErrorIs(t, r.VacuumRecords(3, true), errors.ErrReadOnly)
+
+	require.NoError(t, w.VacuumRecords(3, true))
+	assert.Eventually(t, func() bool { return r.MinimumRecordID() == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, r.Close())
+	assert.FileExists(t, filepath.Join(dir, "lock"))
+	require.NoError(t, w.Close())
+
+	// Readers only lock the WAL while opening it, so that writers may restart
+	// while they are attached, even when a writer that did not shut down
+	// cleanly left its lock file behind.
+	for _, leftover := range []bool{false, true} {
+		if leftover {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "lock"), nil, 0644))
+		}
+		r, err = New(roConf)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), r.MinimumRecordID())
+		id := r.CurrentRecordID()
+
+		w, err = New(conf)
+		require.NoError(t, err)
+		require.NoError(t, w.WriteObject([]byte("restarted")))
+		assert.Eventually(t, func() bool { return r.CurrentRecordID() == id+1 }, 5*time.Second, 10*time.Millisecond)
+		reader, err := r.ReadObject(id + 1)
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "restarted", string(data))
+		require.NoError(t, w.Close())
+		require.NoError(t, r.Close())
+	}
+
+	roConf.Store = NewFileStore(dir)
+	r, err = New(roConf)
+	require.NoError(t, err)
+	_, err = r.ReadObject(5)
+	assert.ErrorIs(t, err, errs.ErrUnsupported)
+	require.NoError(t, r.Close())
+}
+
+func TestWALLockTimeout(t *testing.T) {
+	// The lock is held by another process.
+	dir := t.TempDir()
+	holder, err := flock.New(filepath.Join(dir, "lock"))
+	require.NoError(t, err)
+	require.NoError(t, holder.Lock())
+	data, err := json.Marshal(LockInfo{PID: os.Getppid()})
+	require.NoError(t, err)
+	require.NoError(t, holder.Write(data))
+
+	_, err = New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	var lockErr errors.CannotAcquireWALLockError
+	require.ErrorAs(t, err, &lockErr)
+	assert.Equal(t, os.Getppid(), lockErr.PID)
+
+	start := time.Now()
+	_, err = New(Config{WorkDir: dir, Logger: stdlog.Discard, LockTimeout: 100 * time.Millisecond})
+	require.ErrorAs(t, err, &lockErr)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = holder.Remove()
+	}()
+	w, err := New(Config{WorkDir: dir, Logger: stdlog.Discard, LockTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func TestInspectLock(t *testing.T) {
+	dir := t.TempDir()
+	_, err := InspectLock(dir)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Lock files written by older versions hold a big-endian PID.
+	legacy := make([]byte, 8)
+	binary.BigEndian.PutUint64(legacy, uint64(os.Getpid()))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lock"), legacy, 0644))
+	info, err := InspectLock(dir)
+	require.NoError(t, err)
+	assert.Equal(t, LockInfo{PID: os.Getpid()}, info)
+
+	w, err := New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	require.NoError(t, err)
+	info, err = InspectLock(dir)
+	require.NoError(t, err)
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, hostname, info.Hostname)
+	assert.Equal(t, exe, info.Executable)
+	assert.True(t, info.Held)
+	assert.False(t, info.StartTime.IsZero())
+	assert.False(t, info.StartTime.After(info.AcquiredAt))
+	assert.Greater(t, info.Age(), time.Duration(0))
+
+	require.NoError(t, w.Close())
+	_, err = InspectLock(dir)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestWALStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "lock")
+	writeLock := func(info LockInfo) {
+		data, err := json.Marshal(info)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(lockPath, data, 0644))
+	}
+
+	// The lock file records a running process that no longer holds the lock.
+	// Its start time tells whether it wrote the file, or merely took the
+	// PID of the process that did.
+	ppid := os.Getppid()
+	started, err := procutils.GetPIDStartTime(ppid)
+	require.NoError(t, err)
+
+	writeLock(LockInfo{PID: ppid, StartTime: started})
+	_, err = New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	var lockErr errors.CannotAcquireWALLockError
+	require.ErrorAs(t, err, &lockErr)
+	assert.Equal(t, ppid, lockErr.PID)
+
+	writeLock(LockInfo{PID: ppid, StartTime: started.Add(-time.Hour)})
+	w, err := New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	require.NoError(t, err)
+	info, err := InspectLock(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+	require.NoError(t, w.Close())
+}
+
+// TestWALEpoch ensures writers are fenced out once another writer opens the
+// WAL, regardless of the store in use.
+func TestWALEpoch(t *testing.T) {
+	stores := map[string]func(dir string) SegmentStore{
+		"MMap": func(dir string) SegmentStore { return NewMMapStore(dir) },
+		"File": func(dir string) SegmentStore { return NewFileStore(dir) },
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			conf := Config{WorkDir: dir, Logger: stdlog.Discard, Store: store(dir)}
+			w, err := New(conf)
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), w.Epoch())
+			require.NoError(t, w.WriteObject([]byte("first")))
+			require.NoError(t, w.Close())
+
+			old, err := New(conf)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), old.Epoch())
+
+			// Another process takes over the WorkDir while the writer is paused,
+			// after its lock file is removed.
+			lockPath := filepath.Join(dir, "lock")
+			require.NoError(t, os.Remove(lockPath))
+			holder, err := flock.New(lockPath)
+			require.NoError(t, err)
+			require.NoError(t, holder.Lock())
+			epoch := make([]byte, 8)
+			binary.BigEndian.PutUint64(epoch, 3)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "epoch"), epoch, 0644))
+
+			var staleErr errors.StaleEpochError
+			require.ErrorAs(t, old.WriteObject([]byte("stale")), &staleErr)
+			assert.Equal(t, errors.StaleEpochError{Epoch: 2, Current: 3}, staleErr)
+			_, err = old.WriteBatch([][]byte{[]byte("stale")})
+			assert.ErrorAs(t, err, &staleErr)
+			require.NoError(t, old.Close())
+
+			// Closing the stale handle leaves the new holder's lock in place.
+			info, err := InspectLock(dir)
+			require.NoError(t, err)
+			assert.True(t, info.Held)
+			require.NoError(t, holder.Remove())
+
+			w, err = New(conf)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, w.Close()) }()
+			assert.Equal(t, int64(4), w.Epoch())
+			assert.Equal(t, int64(0), w.CurrentRecordID())
+		})
+	}
+}
+
+func TestWALAlreadyOpen(t *testing.T) {
+	dir := t.TempDir()
+	canonical, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	link := filepath.Join(t.TempDir(), "link")
+	require.NoError(t, os.Symlink(dir, link))
+
+	w, err := New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	require.NoError(t, err)
+	for _, path := range []string{dir, link, dir + "/."} {
+		_, err = New(Config{WorkDir: path, Logger: stdlog.Discard, SharedHandles: true})
+		var openErr errors.AlreadyOpenError
+		require.ErrorAs(t, err, &openErr)
+		assert.Equal(t, canonical, openErr.WorkDir)
+	}
+
+	// Read-only WALs may be opened alongside the writer.
+	r, err := New(Config{WorkDir: dir, Logger: stdlog.Discard, ReadOnly: true})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, w.Close(), errors.ErrClosed)
+
+	// Handles are shared as long as every open sets SharedHandles.
+	conf := Config{WorkDir: dir, Logger: stdlog.Discard, SharedHandles: true}
+	first, err := New(conf)
+	require.NoError(t, err)
+	second, err := New(Config{WorkDir: link, Logger: stdlog.Discard, SharedHandles: true})
+	require.NoError(t, err)
+	_, err = New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	assert.ErrorAs(t, err, &errors.AlreadyOpenError{})
+	assert.Equal(t, first.Epoch(), second.Epoch())
+
+	require.NoError(t, first.WriteObject([]byte("first")))
+	require.NoError(t, second.WriteObject([]byte("second")))
+	assert.Equal(t, int64(1), first.CurrentRecordID())
+	require.NoError(t, first.Close())
+	assert.ErrorIs(t, first.Close(), errors.ErrClosed)
+
+	// Closed handles stop working, while the WAL remains open until its last
+	// handle is closed.
+	assertClosed := func(t *testing.T, w WAL) {
+		t.Helper()
+		assert.ErrorIs(t, w.WriteObject([]byte("closed")), errors.ErrClosed)
+		_, err := w.WriteBatch([][]byte{[]byte("closed")})
+		assert.ErrorIs(t, err, errors.ErrClosed)
+		_, err = w.NewObjectWriter()
+		assert.ErrorIs(t, err, errors.ErrClosed)
+		_, err = w.ReadObject(0)
+		assert.ErrorIs(t, err, errors.ErrClosed)
+		cur := w.ReadObjects(0, true)
+		assert.False(t, cur.Next())
+		assert.ErrorIs(t, cur.Err(), errors.ErrClosed)
+		for _, err := range w.All(0) {
+			assert.ErrorIs(t, err, errors.ErrClosed)
+		}
+		assert.ErrorIs(t, w.VacuumRecords(0, true), errors.ErrClosed)
+		assert.ErrorIs(t, w.TruncateAfter(0), errors.ErrClosed)
+		assert.ErrorIs(t, w.Sync(), errors.ErrClosed)
+	}
+	assertClosed(t, first)
+	require.NoError(t, second.WriteObject([]byte("third")))
+	_, err = New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	assert.ErrorAs(t, err, &errors.AlreadyOpenError{})
+	require.NoError(t, second.Close())
+	assertClosed(t, first)
+	assertClosed(t, second)
+
+	w, err = New(Config{WorkDir: dir, Logger: stdlog.Discard})
+	require.NoError(t, err)
+	defer func() { require.NoError(t, w.Close()) }()
+	assert.Equal(t, int64(2), w.CurrentRecordID())
 }